@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mozilla-services/yaml"
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/gcpkms"
+	sops_yaml "go.mozilla.org/sops/v3/stores/yaml"
+	"go.mozilla.org/sops/v3/version"
+)
+
+const redacted = "REDACTED"
+
+var documentSeparatorRegex = regexp.MustCompile(`(?m)^---\s*$`)
+
+// writeAudit renders the manifests of the release and writes them to the
+// audit file. Secrets are redacted unless AuditIncludeSecrets is set and the
+// file is encrypted with SOPS if an AuditKmsKey is given.
+func (p Plugin) writeAudit(chart string, valueArgs []string) error {
+	manifests, err := p.renderManifests(chart, valueArgs)
+	if err != nil {
+		return err
+	}
+	if p.PrintOnly {
+		return nil
+	}
+
+	if !p.AuditIncludeSecrets {
+		if manifests, err = redactSecrets(manifests); err != nil {
+			return fmt.Errorf("could not redact secrets: %w", err)
+		}
+	}
+	if p.AuditKmsKey != "" {
+		if manifests, err = encryptYAML(manifests, p.AuditKmsKey); err != nil {
+			return fmt.Errorf("could not encrypt manifests: %w", err)
+		}
+	}
+	return ioutil.WriteFile(p.AuditFile, manifests, 0600)
+}
+
+// redactSecrets replaces the values of all Secret manifests. All other
+// manifests are kept as they are.
+func redactSecrets(manifests []byte) ([]byte, error) {
+	docs := documentSeparatorRegex.Split(string(manifests), -1)
+	for i, doc := range docs {
+		var m map[interface{}]interface{}
+		if err := yaml.Unmarshal([]byte(doc), &m); err != nil {
+			return nil, fmt.Errorf("could not parse manifest %d: %w", i, err)
+		}
+		if m["kind"] != "Secret" {
+			continue
+		}
+		for _, field := range []string{"data", "stringData"} {
+			values, ok := m[field].(map[interface{}]interface{})
+			if !ok {
+				continue
+			}
+			for k := range values {
+				values[k] = redacted
+			}
+		}
+		out, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("could not write manifest %d: %w", i, err)
+		}
+		docs[i] = "\n" + string(out)
+	}
+	return []byte(strings.Join(docs, "---")), nil
+}
+
+// encryptYAML encrypts the yaml documents with SOPS using the GCP KMS key
+func encryptYAML(in []byte, kmsKey string) ([]byte, error) {
+	store := &sops_yaml.Store{}
+	branches, err := store.LoadPlainFile(bytes.TrimSpace(in))
+	if err != nil {
+		return nil, err
+	}
+
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:         []sops.KeyGroup{{gcpkms.NewMasterKeyFromResourceID(kmsKey)}},
+			UnencryptedSuffix: "_unencrypted",
+			Version:           version.Version,
+		},
+	}
+	dataKey, errs := tree.GenerateDataKey()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("could not generate data key: %v", errs)
+	}
+	if err := common.EncryptTree(common.EncryptTreeOpts{
+		Tree:    &tree,
+		Cipher:  aes.NewCipher(),
+		DataKey: dataKey,
+	}); err != nil {
+		return nil, err
+	}
+	return store.EmitEncryptedFile(tree)
+}
+
+// dumpFailedManifests renders the manifests of the failed deploy and uploads
+// them with redacted secrets to gs://$BUCKET/failures/$RELEASE-$NAMESPACE-$TIMESTAMP.yaml.
+// The namespace keeps the dumps of parallel namespace deploys apart.
+func (p Plugin) dumpFailedManifests(chart string, valueArgs []string) {
+	manifests, err := p.renderManifests(chart, valueArgs)
+	if err != nil {
+		log.Printf("could not dump manifests: %v", err)
+		return
+	}
+	if manifests, err = redactSecrets(manifests); err != nil {
+		log.Printf("could not redact secrets of the dumped manifests: %v", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(p.tempDir(""), "manifests-*.yaml")
+	if err != nil {
+		log.Printf("could not create temp file for the dumped manifests: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(manifests)
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		log.Printf("could not write the dumped manifests: %v", err)
+		return
+	}
+
+	url := fmt.Sprintf("gs://%s/failures/%s-%s-%s.yaml", p.Bucket, p.Release, p.Namespace, time.Now().UTC().Format("20060102T150405Z"))
+	if err := p.cpPackage(tmp.Name(), url); err != nil {
+		log.Printf("could not upload the dumped manifests: %v", err)
+		return
+	}
+	log.Printf("dumped manifests of the failed deploy to %s", url)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testManifests = `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  password: not-a-secret
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+data:
+  password: czNjcmV0
+stringData:
+  token: t0ken
+`
+
+func TestRedactSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no secrets",
+			in:   "---\nkind: ConfigMap\ndata:\n  a: b\n",
+			want: "---\nkind: ConfigMap\ndata:\n  a: b\n",
+		},
+		{
+			name: "secret",
+			in:   "---\nkind: Secret\ndata:\n  a: czNjcmV0\n  b: czNjcmV0\n",
+			want: "---\ndata:\n  a: REDACTED\n  b: REDACTED\nkind: Secret\n",
+		},
+		{
+			name: "string data",
+			in:   "kind: Secret\nstringData:\n  a: s3cret\n",
+			want: "\nkind: Secret\nstringData:\n  a: REDACTED\n",
+		},
+		{
+			name: "secret without data",
+			in:   "---\nkind: Secret\ntype: Opaque\n",
+			want: "---\nkind: Secret\ntype: Opaque\n",
+		},
+		{
+			name:    "invalid manifest",
+			in:      "---\nkind: [Secret\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redactSecrets([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("redactSecrets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("redactSecrets() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	calls, restore := fakeCommands(t, map[string]string{"helm": "cat <<'EOF'\n" + testManifests + "EOF"})
+	defer restore()
+
+	tests := []struct {
+		includeSecrets bool
+		want           []string
+		notWant        []string
+	}{
+		{false, []string{"password: not-a-secret", "password: REDACTED", "token: REDACTED"}, []string{"czNjcmV0", "t0ken"}},
+		{true, []string{"password: not-a-secret", "password: czNjcmV0", "token: t0ken"}, []string{redacted}},
+	}
+	for _, tt := range tests {
+		p := newTestPlugin()
+		p.AuditFile = filepath.Join(dir, "audit.yaml")
+		p.AuditIncludeSecrets = tt.includeSecrets
+		if err := p.writeAudit("chart", []string{"-f", "values.yaml"}); err != nil {
+			t.Fatalf("writeAudit() error = %v", err)
+		}
+		b, err := ioutil.ReadFile(p.AuditFile)
+		if err != nil {
+			t.Fatalf("audit file was not written: %v", err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(string(b), w) {
+				t.Errorf("audit file with include secrets %v has no %q:\n%s", tt.includeSecrets, w, b)
+			}
+		}
+		for _, w := range tt.notWant {
+			if strings.Contains(string(b), w) {
+				t.Errorf("audit file with include secrets %v has %q:\n%s", tt.includeSecrets, w, b)
+			}
+		}
+	}
+	if !hasCall(calls(), "helm template app chart -f values.yaml --namespace default") {
+		t.Errorf("release was not rendered: %q", calls())
+	}
+}
+
+// uploadingGsutil is a fake gsutil which records the destination and the
+// content of uploaded files
+const uploadingGsutil = `while [ "$1" != cp ]; do shift; done
+echo "destination: $3" >> "$FAKE_DIR/calls"
+sed 's/^/uploaded: /' "$2" >> "$FAKE_DIR/calls"`
+
+// uploads returns the destination and the content of the uploaded files
+func uploads(calls []string) (destinations []string, content string) {
+	for _, c := range calls {
+		switch {
+		case strings.HasPrefix(c, "destination: "):
+			destinations = append(destinations, strings.TrimPrefix(c, "destination: "))
+		case strings.HasPrefix(c, "uploaded: "):
+			content += strings.TrimPrefix(c, "uploaded: ") + "\n"
+		}
+	}
+	return destinations, content
+}
+
+func TestDumpFailedManifests(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":   "cat <<'EOF'\n" + testManifests + "EOF",
+		"gsutil": uploadingGsutil,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	lines := captureLog(func() { p.dumpFailedManifests("app-1.0.0.tgz", []string{"-f", "values.yaml"}) })
+
+	got := calls()
+	if got[0] != "helm template app app-1.0.0.tgz -f values.yaml --namespace default" {
+		t.Errorf("dumpFailedManifests() rendered with %q, want the inputs of the deploy", got[0])
+	}
+	destinations, content := uploads(got)
+	if len(destinations) != 1 || !regexp.MustCompile(`^gs://charts/failures/app-default-[0-9]{8}T[0-9]{6}Z\.yaml$`).MatchString(destinations[0]) {
+		t.Fatalf("dumpFailedManifests() uploaded to %q, want gs://charts/failures/app-default-$TIMESTAMP.yaml", destinations)
+	}
+	if strings.Contains(content, "czNjcmV0") || strings.Contains(content, "t0ken") {
+		t.Errorf("uploaded manifests contain the secrets:\n%s", content)
+	}
+	if !strings.Contains(content, "password: REDACTED") || !strings.Contains(content, "password: not-a-secret") {
+		t.Errorf("uploaded manifests = %q, want the redacted manifests", content)
+	}
+	if want := "dumped manifests of the failed deploy to " + destinations[0]; lines[len(lines)-1] != want {
+		t.Errorf("dumpFailedManifests() logged %q, want %q", lines, want)
+	}
+}
+
+func TestDumpFailedManifestsRenderFailure(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":   "echo 'Error: template: parse error' >&2; exit 1",
+		"gsutil": uploadingGsutil,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	lines := captureLog(func() { p.dumpFailedManifests("app-1.0.0.tgz", nil) })
+	if !strings.HasPrefix(lines[0], "could not dump manifests: could not render chart") {
+		t.Errorf("dumpFailedManifests() logged %q, want the render failure", lines)
+	}
+	if destinations, _ := uploads(calls()); len(destinations) != 0 {
+		t.Errorf("dumpFailedManifests() uploaded %q without manifests", destinations)
+	}
+}
+
+func TestDeployDumpManifestOnFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		dump       bool
+		upgrade    string
+		wantDumped bool
+	}{
+		{"failed deploy", true, "exit 1", true},
+		{"disabled", false, "exit 1", false},
+		{"successful deploy", true, "exit 0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm": fmt.Sprintf(`case "$1" in
+template) echo 'kind: ConfigMap' ;;
+upgrade) %s ;;
+esac`, tt.upgrade),
+				"kubectl": `echo 'deployment "app" successfully rolled out'`,
+				"gsutil":  uploadingGsutil,
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Bucket = "charts"
+			p.DumpManifestOnFailure = tt.dump
+			var err error
+			captureLog(func() { err = p.deployPackage() })
+			if (err != nil) != (tt.upgrade != "exit 0") {
+				t.Errorf("deployPackage() error = %v", err)
+			}
+
+			got := calls()
+			if rendered := hasCall(got, "helm template app app-1.0.0.tgz"); rendered != tt.wantDumped {
+				t.Errorf("manifests rendered %v, want %v: %q", rendered, tt.wantDumped, got)
+			}
+			if destinations, content := uploads(got); (len(destinations) == 1 && content == "kind: ConfigMap\n") != tt.wantDumped {
+				t.Errorf("manifests uploaded to %q: %q, want dumped %v", destinations, content, tt.wantDumped)
+			}
+		})
+	}
+}
+
+func TestDeployNamespacesDumpManifestOnFailure(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm": `case "$1" in
+template) echo 'kind: ConfigMap' ;;
+upgrade) exit 1 ;;
+esac`,
+		"kubectl": "exit 0",
+		"gsutil":  uploadingGsutil,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	p.DumpManifestOnFailure = true
+	p.Namespaces = []string{"staging", "prod"}
+	var err error
+	captureLog(func() { err = p.deployNamespaces() })
+	if err == nil {
+		t.Fatal("deployNamespaces() error = nil, want the failed deploys")
+	}
+
+	// the namespaces fail in the same second and must not overwrite each other
+	destinations, _ := uploads(calls())
+	sort.Strings(destinations)
+	re := regexp.MustCompile(`^gs://charts/failures/app-(prod|staging)-[0-9]{8}T[0-9]{6}Z\.yaml$`)
+	if len(destinations) != 2 || !re.MatchString(destinations[0]) || !re.MatchString(destinations[1]) ||
+		re.FindStringSubmatch(destinations[0])[1] != "prod" || re.FindStringSubmatch(destinations[1])[1] != "staging" {
+		t.Errorf("deployNamespaces() uploaded to %q, want one dump per namespace", destinations)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/mozilla-services/yaml"
+)
+
+// chartFile is the part of the Chart.yaml used by the plugin
+type chartFile struct {
+	Name         string            `yaml:"name"`
+	Version      string            `yaml:"version"`
+	Dependencies []chartDependency `yaml:"dependencies"`
+}
+
+type chartDependency struct {
+	Name       string `yaml:"name"`
+	Repository string `yaml:"repository"`
+}
+
+// readChartFile reads the Chart.yaml of the chart in chartPath
+func readChartFile(chartPath string) (*chartFile, error) {
+	b, err := ioutil.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var c chartFile
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("could not parse Chart.yaml: %w", err)
+	}
+	return &c, nil
+}
+
+// warnMissingRepos logs a warning for each dependency of the chart whose
+// repository was not added by addRepo, as helm dependency update will not
+// be able to fetch it.
+func (p Plugin) warnMissingRepos() {
+	c, err := readChartFile(p.ChartPath)
+	if err != nil {
+		log.Printf("could not check chart dependencies: %v", err)
+		return
+	}
+
+	names := map[string]bool{"stable": true}
+	urls := map[string]bool{strings.TrimSuffix(p.HelmStableRepo, "/"): true}
+	for _, d := range c.Dependencies {
+		repo := d.Repository
+		switch {
+		case repo == "", strings.HasPrefix(repo, "file://"), strings.HasPrefix(repo, "oci://"):
+			continue
+		case strings.HasPrefix(repo, "@"):
+			if names[strings.TrimPrefix(repo, "@")] {
+				continue
+			}
+		case strings.HasPrefix(repo, "alias:"):
+			if names[strings.TrimPrefix(repo, "alias:")] {
+				continue
+			}
+		case urls[strings.TrimSuffix(repo, "/")]:
+			continue
+		}
+		log.Printf("warning: repository '%s' of dependency '%s' was not added", repo, d.Name)
+	}
+}
+
+// dependencyRepos returns the repositories of the chart dependencies. A
+// chart without a readable Chart.yaml has none.
+func (p Plugin) dependencyRepos() []string {
+	c, err := readChartFile(p.ChartPath)
+	if err != nil {
+		return nil
+	}
+	var repos []string
+	for _, d := range c.Dependencies {
+		repos = append(repos, d.Repository)
+	}
+	return repos
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testChartFile = `name: app
+version: 1.2.3
+dependencies:
+- name: redis
+  repository: "@stable"
+- name: postgres
+  repository: https://charts.helm.sh/stable/
+- name: common
+  repository: file://../common
+- name: oci
+  repository: oci://europe-docker.pkg.dev/project/charts
+- name: private
+  repository: https://charts.example.com
+`
+
+// writeTestChart writes the Chart.yaml into a new chart dir
+func writeTestChart(t *testing.T, chartFile string) (dir string, remove func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "chart-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte(chartFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestWarnMissingRepos(t *testing.T) {
+	dir, remove := writeTestChart(t, testChartFile)
+	defer remove()
+
+	p := newTestPlugin()
+	p.ChartPath = dir
+	p.HelmStableRepo = "https://charts.helm.sh/stable"
+	var warnings []string
+	for _, l := range captureLog(p.warnMissingRepos) {
+		if strings.HasPrefix(l, "warning:") {
+			warnings = append(warnings, l)
+		}
+	}
+	want := "warning: repository 'https://charts.example.com' of dependency 'private' was not added"
+	if len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("warnMissingRepos() logged %q, want only %q", warnings, want)
+	}
+}
+
+func TestDependencyActionOrder(t *testing.T) {
+	dir, remove := writeTestChart(t, testChartFile)
+	defer remove()
+	calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0", "gcloud": "echo t0ken"})
+	defer restore()
+	defer resetMasked()()
+
+	p := newTestPlugin()
+	p.ChartPath = dir
+	p.HelmStableRepo = "https://charts.helm.sh/stable"
+	if err := p.execAction(dependencyPkg); err != nil {
+		t.Fatalf("execAction() error = %v", err)
+	}
+	// the repos are added and the registries logged in to before the
+	// dependencies are updated
+	want := []string{
+		"helm repo add stable https://charts.helm.sh/stable",
+		"helm repo update",
+		"gcloud auth print-access-token",
+		"helm registry login europe-docker.pkg.dev -u oauth2accesstoken --password-stdin",
+		"helm dependency update " + dir,
+	}
+	if got := calls(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("dep action ran %q, want %q", got, want)
+	}
+}
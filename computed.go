@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// valueProviders compute the values of ComputedValues by provider name. The
+// argument is the part after the colon, e.g. DRONE_COMMIT for env:DRONE_COMMIT.
+var valueProviders = map[string]func(arg string) (string, error){
+	"now": func(string) (string, error) {
+		return time.Now().UTC().Format(time.RFC3339), nil
+	},
+	"unix": func(string) (string, error) {
+		return strconv.FormatInt(time.Now().Unix(), 10), nil
+	},
+	"env": func(name string) (string, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("env variable %s is not set", name)
+		}
+		return v, nil
+	},
+}
+
+// computedValue is a key=provider[:arg] entry of ComputedValues
+type computedValue struct {
+	key, provider, arg string
+}
+
+// parseComputedValue parses a key=provider[:arg] entry
+func parseComputedValue(s string) (computedValue, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return computedValue{}, fmt.Errorf("computed value '%s' is not a key=provider pair", s)
+	}
+	pa := strings.SplitN(kv[1], ":", 2)
+	v := computedValue{key: kv[0], provider: pa[0]}
+	if len(pa) == 2 {
+		v.arg = pa[1]
+	}
+	if _, ok := valueProviders[v.provider]; !ok {
+		return v, fmt.Errorf("unknown provider '%s' of computed value '%s'", v.provider, v.key)
+	}
+	return v, nil
+}
+
+// computedValueArgs computes the ComputedValues and returns them as
+// --set-string arguments
+func (p Plugin) computedValueArgs() ([]string, error) {
+	var args []string
+	for _, s := range p.ComputedValues {
+		v, err := parseComputedValue(s)
+		if err != nil {
+			return nil, err
+		}
+		value, err := valueProviders[v.provider](v.arg)
+		if err != nil {
+			return nil, fmt.Errorf("could not compute value '%s': %w", v.key, err)
+		}
+		args = append(args, "--set-string", shellQuote(v.key+"="+helmEscape(value)))
+	}
+	return args, nil
+}
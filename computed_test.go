@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseComputedValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    computedValue
+		wantErr bool
+	}{
+		{"deployedAt=now", computedValue{key: "deployedAt", provider: "now"}, false},
+		{"build.time=unix", computedValue{key: "build.time", provider: "unix"}, false},
+		{"commit=env:DRONE_COMMIT", computedValue{key: "commit", provider: "env", arg: "DRONE_COMMIT"}, false},
+		{"url=env:A:B", computedValue{key: "url", provider: "env", arg: "A:B"}, false},
+		{"deployedAt", computedValue{}, true},
+		{"=now", computedValue{}, true},
+		{"deployedAt=today", computedValue{}, true},
+		{"deployedAt=", computedValue{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseComputedValue(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseComputedValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseComputedValue() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputedValueArgs(t *testing.T) {
+	defer restoreEnv("COMPUTED_TEST_COMMIT", "COMPUTED_TEST_MISSING")()
+	os.Setenv("COMPUTED_TEST_COMMIT", "abc,def")
+	os.Unsetenv("COMPUTED_TEST_MISSING")
+
+	p := newTestPlugin()
+	p.ComputedValues = []string{"commit=env:COMPUTED_TEST_COMMIT", "deployedAt=now", "ts=unix"}
+	before := time.Now().Add(-time.Second)
+	args, err := p.computedValueArgs()
+	if err != nil {
+		t.Fatalf("computedValueArgs() error = %v", err)
+	}
+	if len(args) != 6 || args[0] != "--set-string" || args[2] != "--set-string" || args[4] != "--set-string" {
+		t.Fatalf("computedValueArgs() = %q, want three --set-string values", args)
+	}
+	if args[1] != `'commit=abc\,def'` {
+		t.Errorf("env value = %s, want the escaped env variable", args[1])
+	}
+	deployedAt, err := time.Parse(time.RFC3339, strings.TrimSuffix(strings.TrimPrefix(args[3], "'deployedAt="), "'"))
+	if err != nil || deployedAt.Before(before.Truncate(time.Second)) {
+		t.Errorf("now value = %s, want the current time: %v", args[3], err)
+	}
+	ts, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(args[5], "'ts="), "'"), 10, 64)
+	if err != nil || ts < before.Unix() {
+		t.Errorf("unix value = %s, want the current unix time: %v", args[5], err)
+	}
+
+	p.ComputedValues = []string{"commit=env:COMPUTED_TEST_MISSING"}
+	if _, err := p.computedValueArgs(); err == nil || !strings.Contains(err.Error(), "COMPUTED_TEST_MISSING is not set") {
+		t.Errorf("computedValueArgs() error = %v, want the missing env variable", err)
+	}
+}
+
+func TestValidateComputedValues(t *testing.T) {
+	p := newTestPlugin()
+	p.ComputedValues = []string{"deployedAt=now", "commit=env:DRONE_COMMIT"}
+	if err := p.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	p.ComputedValues = []string{"deployedAt=today"}
+	if err := p.validate(); err == nil {
+		t.Error("validate() accepted an unknown provider")
+	}
+}
+
+func TestDeployComputedValues(t *testing.T) {
+	defer restoreEnv("COMPUTED_TEST_COMMIT")()
+	os.Setenv("COMPUTED_TEST_COMMIT", "abc")
+
+	p := newTestPlugin()
+	p.Values = []string{"replicas=2"}
+	p.ComputedValues = []string{"commit=env:COMPUTED_TEST_COMMIT"}
+	if got := deployCommand(t, p); !strings.HasPrefix(got, "helm upgrade app app-1.0.0.tgz --set replicas=2 --set-string commit=abc ") {
+		t.Errorf("helm upgrade = %q, want the computed value", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/mozilla-services/yaml"
+)
+
+// loadConfigFile sets the parameters of the YAML or JSON config file as
+// PLUGIN_ env variables, so they are parsed like all other parameters.
+// Parameters which are already set in the environment are not overridden.
+// Like drone does for settings, lists are joined with commas and objects and
+// lists of objects are passed as JSON.
+func loadConfigFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("could not parse %s: %w", file, err)
+	}
+
+	names := parameterNames()
+	for k, v := range config {
+		name, ok := names[parameterKey(k)]
+		if !ok {
+			return fmt.Errorf("unknown parameter '%s' in %s", k, file)
+		}
+		// a parameter without a value keeps its default
+		if v == nil || os.Getenv("PLUGIN_"+name) != "" || os.Getenv(name) != "" {
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid value of parameter '%s': %w", k, err)
+		}
+		if err := os.Setenv("PLUGIN_"+name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parameterNames returns the env names of all parameters by their parameterKey
+func parameterNames() map[string]string {
+	names := map[string]string{}
+	t := reflect.TypeOf(Plugin{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("envconfig"); name != "" {
+			names[parameterKey(name)] = name
+		}
+	}
+	return names
+}
+
+// parameterKey returns the lower case name without underscores, so that
+// value_files, valueFiles and VALUE_FILES are the same parameter
+func parameterKey(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// configValue returns the env representation of a config file value
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case []interface{}, map[interface{}]interface{}:
+				// lists of objects are passed as JSON
+				b, err := json.Marshal(jsonCompatible(v))
+				return string(b), err
+			}
+			items[i], _ = configValue(item)
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		b, err := json.Marshal(jsonCompatible(v))
+		return string(b), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// jsonCompatible converts the yaml maps to maps with string keys
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{"string", "chart", "chart"},
+		{"bool", true, "true"},
+		{"int", 300, "300"},
+		{"list", []interface{}{"a=1", "b=2"}, "a=1,b=2"},
+		{"empty list", []interface{}{}, ""},
+		{"null", nil, ""},
+		{"list with null", []interface{}{"a=1", nil}, "a=1,"},
+		{"object", map[interface{}]interface{}{"tag": "v1"}, `{"tag":"v1"}`},
+		{"list of objects", []interface{}{
+			map[interface{}]interface{}{"chart_path": "web"},
+			map[interface{}]interface{}{"chart_path": "db", "values": []interface{}{"a=1"}},
+		}, `[{"chart_path":"web"},{"chart_path":"db","values":["a=1"]}]`},
+		{"nested object", map[interface{}]interface{}{"image": map[interface{}]interface{}{"tag": "v1"}}, `{"image":{"tag":"v1"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := configValue(tt.in)
+			if err != nil {
+				t.Fatalf("configValue() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("configValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParameterNames(t *testing.T) {
+	names := parameterNames()
+	for _, key := range []string{"value_files", "valueFiles", "VALUE_FILES", "valuefiles"} {
+		if got := names[parameterKey(key)]; got != "VALUE_FILES" {
+			t.Errorf("parameter of %q = %q, want VALUE_FILES", key, got)
+		}
+	}
+	// the config file is only read from PLUGIN_CONFIG_FILE
+	if _, ok := names[parameterKey("config_file")]; ok {
+		t.Error("config_file is a parameter of the config file")
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	envNames := []string{"PLUGIN_CHART_PATH", "PLUGIN_VALUES", "PLUGIN_VALUE_FILES", "PLUGIN_WAIT_TIMEOUT", "WAIT_TIMEOUT", "PLUGIN_RELEASES", "PLUGIN_NAMESPACE"}
+	defer restoreEnv(envNames...)()
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "yaml",
+			file:    "config.yaml",
+			content: "chart_path: charts/app\nvalues:\n- image.tag=v1\n- replicas=2\nwait_timeout: 600\n",
+			want:    map[string]string{"PLUGIN_CHART_PATH": "charts/app", "PLUGIN_VALUES": "image.tag=v1,replicas=2", "PLUGIN_WAIT_TIMEOUT": "600"},
+		},
+		{
+			name:    "json camel case",
+			file:    "config.json",
+			content: `{"chartPath": "charts/app", "valueFiles": ["a.yaml", "b.yaml"], "releases": [{"chart_path": "charts/db"}]}`,
+			want:    map[string]string{"PLUGIN_CHART_PATH": "charts/app", "PLUGIN_VALUE_FILES": "a.yaml,b.yaml", "PLUGIN_RELEASES": `[{"chart_path":"charts/db"}]`},
+		},
+		{
+			name:    "env overrides",
+			file:    "config.yaml",
+			content: "chart_path: charts/app\nwait_timeout: 600\nvalues: [replicas=2]\n",
+			env:     map[string]string{"PLUGIN_CHART_PATH": "charts/web", "WAIT_TIMEOUT": "100"},
+			// the unprefixed env variable is used by envconfig as well
+			want: map[string]string{"PLUGIN_CHART_PATH": "charts/web", "PLUGIN_WAIT_TIMEOUT": "", "PLUGIN_VALUES": "replicas=2"},
+		},
+		{
+			name:    "null",
+			file:    "config.yaml",
+			content: "chart_path: charts/app\nnamespace:\n",
+			want:    map[string]string{"PLUGIN_CHART_PATH": "charts/app", "PLUGIN_NAMESPACE": ""},
+		},
+		{
+			name:    "unknown parameter",
+			file:    "config.yaml",
+			content: "chart_paths: charts/app\n",
+			wantErr: true,
+		},
+		{
+			name:    "config file",
+			file:    "config.yaml",
+			content: "config_file: other.yaml\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			file:    "config.yaml",
+			content: "chart_path: [charts/app\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, n := range envNames {
+				os.Unsetenv(n)
+			}
+			for n, v := range tt.env {
+				os.Setenv(n, v)
+			}
+			file := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadConfigFile(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for n, want := range tt.want {
+				if got := os.Getenv(n); got != want {
+					t.Errorf("%s = %q, want %q", n, got, want)
+				}
+			}
+		})
+	}
+
+	if err := loadConfigFile(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("loadConfigFile() of a missing file succeeded")
+	}
+}
+
+func TestConfigFileEnvPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreEnv("PLUGIN_ACTIONS", "PLUGIN_CHART_PATH", "PLUGIN_VALUES", "PLUGIN_WAIT_TIMEOUT", "WAIT_TIMEOUT")()
+	os.Unsetenv("PLUGIN_ACTIONS")
+	os.Unsetenv("PLUGIN_WAIT_TIMEOUT")
+	os.Unsetenv("PLUGIN_VALUES")
+	os.Setenv("PLUGIN_CHART_PATH", "charts/web")
+	os.Setenv("WAIT_TIMEOUT", "100")
+
+	file := filepath.Join(dir, "config.yaml")
+	content := "actions: [lint]\nchartPath: charts/app\nwaitTimeout: 600\nvalues: [image.tag=v1, replicas=2]\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(file); err != nil {
+		t.Fatalf("loadConfigFile() error = %v", err)
+	}
+	var p Plugin
+	if err := envconfig.Process("plugin", &p); err != nil {
+		t.Fatalf("envconfig.Process() error = %v", err)
+	}
+	if p.ChartPath != "charts/web" || p.WaitTimeout != 100 {
+		t.Errorf("chart path, wait timeout = %q, %d, want the env values charts/web, 100", p.ChartPath, p.WaitTimeout)
+	}
+	if len(p.Values) != 2 || p.Values[0] != "image.tag=v1" || p.Values[1] != "replicas=2" {
+		t.Errorf("values = %q, want the values of the file", p.Values)
+	}
+}
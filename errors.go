@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// ansiRegex matches ANSI escape sequences like color codes
+var ansiRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// Errors for common failure modes, detected from the output of failed commands.
+// Use errors.Is to check for them.
+var (
+	ErrReleaseNotFound = errors.New("release not found")
+	ErrAuthFailed      = errors.New("authentication failed")
+	ErrTimeout         = errors.New("timeout")
+	ErrChartNotFound   = errors.New("chart not found")
+)
+
+// errorPatterns maps lower case output snippets to the error they indicate
+var errorPatterns = []struct {
+	err      error
+	snippets []string
+}{
+	{ErrReleaseNotFound, []string{"release: not found", "has no deployed releases"}},
+	{ErrChartNotFound, []string{"chart not found", "no chart version found", "no chart name found", "failed to download"}},
+	{ErrTimeout, []string{"timed out waiting", "context deadline exceeded", "i/o timeout"}},
+	{ErrAuthFailed, []string{"unauthorized", "invalid_grant", "could not find default credentials", "you do not currently have an active account", "permission denied", "permission(s)", "forbidden", "code=403"}},
+}
+
+// cmdError is the error of a failed command, optionally marked as one of the
+// common failure modes.
+type cmdError struct {
+	kind error
+	err  error
+}
+
+func (e *cmdError) Error() string {
+	return e.err.Error()
+}
+
+func (e *cmdError) Unwrap() error {
+	return e.err
+}
+
+func (e *cmdError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+// classifyError marks err with the failure mode found in the command output
+func classifyError(err error, output string) error {
+	if err == nil {
+		return nil
+	}
+	output = strings.ToLower(output)
+	for _, p := range errorPatterns {
+		for _, s := range p.snippets {
+			if strings.Contains(output, s) {
+				return &cmdError{kind: p.err, err: err}
+			}
+		}
+	}
+	return err
+}
+
+// exitErrorOutput returns the captured standard error of a failed command
+func exitErrorOutput(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return stripANSI(string(exitErr.Stderr))
+	}
+	return ""
+}
+
+// stripANSI removes ANSI escape sequences, so command output can be used in
+// error messages
+func stripANSI(s string) string {
+	return ansiRegex.ReplaceAllString(s, "")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	failed := errors.New("exit status 1")
+	tests := []struct {
+		name   string
+		output string
+		want   error
+	}{
+		{"release not found", "Error: release: not found", ErrReleaseNotFound},
+		{"no deployed releases", `Error: "app" has no deployed releases`, ErrReleaseNotFound},
+		{"chart not found", "Error: chart \"app\" version \"1.0.0\" not found in repo: chart not found", ErrChartNotFound},
+		{"no chart version", "Error: no chart version found for app-1.0.0", ErrChartNotFound},
+		{"timeout", "Error: UPGRADE FAILED: timed out waiting for the condition", ErrTimeout},
+		{"deadline", "Error: context deadline exceeded", ErrTimeout},
+		{"unauthorized", "error: You must be logged in to the server (Unauthorized)", ErrAuthFailed},
+		{"no account", "ERROR: (gcloud.container.clusters.get-credentials) You do not currently have an active account selected.", ErrAuthFailed},
+		{"forbidden", `Error from server (Forbidden): namespaces is forbidden`, ErrAuthFailed},
+		{"missing permission", `ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=403, message=Required "container.clusters.get" permission(s) for "projects/p/locations/europe-west1/clusters/prod".`, ErrAuthFailed},
+		{"unknown", "Error: something else", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyError(failed, tt.output)
+			for _, kind := range []error{ErrReleaseNotFound, ErrAuthFailed, ErrTimeout, ErrChartNotFound} {
+				if errors.Is(err, kind) != (kind == tt.want) {
+					t.Errorf("errors.Is(%v, %v) = %v", err, kind, !(kind == tt.want))
+				}
+			}
+			// the message and the wrapped error are kept
+			if err.Error() != failed.Error() || !errors.Is(err, failed) {
+				t.Errorf("classifyError() = %v, want it to wrap %v", err, failed)
+			}
+			if wrapped := fmt.Errorf("could not deploy: %w", err); tt.want != nil && !errors.Is(wrapped, tt.want) {
+				t.Errorf("wrapped error is not %v", tt.want)
+			}
+		})
+	}
+
+	if err := classifyError(nil, "Error: release: not found"); err != nil {
+		t.Errorf("classifyError(nil) = %v, want nil", err)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{
+		"helm": "echo 'Error: release: not found' >&2; exit 1",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	// run captures the standard error, output takes it from the exit error
+	if err := p.run(exec.Command(helmBin, "status", "app")); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("run() error = %v, want %v", err, ErrReleaseNotFound)
+	}
+	if _, err := p.output(exec.Command(helmBin, "status", "app")); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("output() error = %v, want %v", err, ErrReleaseNotFound)
+	}
+	if _, err := p.releaseRevision(); !errors.Is(err, ErrReleaseNotFound) {
+		t.Errorf("releaseRevision() error = %v, want %v", err, ErrReleaseNotFound)
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"Error: release: not found", "Error: release: not found"},
+		{"\x1b[31mError:\x1b[0m release: not found", "Error: release: not found"},
+		{"\x1b[1;31mbold red\x1b[0m", "bold red"},
+		{"\x1b[?25lhidden cursor\x1b[?25h", "hidden cursor"},
+		{"\x1b[2Kcleared", "cleared"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := stripANSI(tt.in); got != tt.want {
+			t.Errorf("stripANSI(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestColoredCommandErrors(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{
+		"helm": `printf '\033[31mError: UPGRADE FAILED: timed\033[0m out waiting for the condition\n' >&2; exit 1`,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	_, err := p.output(exec.Command(helmBin, "upgrade", "app"))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("output() error = %v, want %v", err, ErrTimeout)
+	}
+	if got := exitErrorOutput(errors.Unwrap(err)); got != "Error: UPGRADE FAILED: timed out waiting for the condition\n" {
+		t.Errorf("exitErrorOutput() = %q, want the output without color codes", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const gitBin = "git"
+
+// cloneChartRepo clones the GitRepo at the GitRef into a temporary directory
+// and returns the directory and the chart at the ChartPath in it. The
+// directory must be removed by the caller, also on error.
+func (p Plugin) cloneChartRepo() (dir, chart string, err error) {
+	dir, err = ioutil.TempDir(p.tempDir(""), "chart-repo-")
+	if err != nil {
+		return "", "", fmt.Errorf("could not create temp dir for the chart repo: %w", err)
+	}
+
+	ref := p.GitRef
+	if ref == "" {
+		ref = "HEAD"
+	}
+	clone := p.cloner
+	if clone == nil {
+		clone = p.gitClone
+	}
+	if err := clone(p.GitRepo, ref, dir); err != nil {
+		return dir, "", fmt.Errorf("could not clone %s at %s: %w", p.GitRepo, ref, err)
+	}
+
+	chart = filepath.Join(dir, p.ChartPath)
+	if p.PrintOnly {
+		// nothing was cloned
+		return dir, chart, nil
+	}
+	if _, err := os.Stat(filepath.Join(chart, "Chart.yaml")); err != nil {
+		return dir, "", fmt.Errorf("could not find chart %s in %s at %s", p.ChartPath, p.GitRepo, ref)
+	}
+	return dir, chart, nil
+}
+
+// gitClone fetches only the ref of the repo into dir, it can be a branch,
+// tag or commit.
+// git fetch --depth 1 $GIT_REPO $GIT_REF && git checkout FETCH_HEAD
+func (p Plugin) gitClone(repo, ref, dir string) error {
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"fetch", "--quiet", "--depth", "1", repo, ref},
+		{"checkout", "--quiet", "FETCH_HEAD"},
+	} {
+		cmd := exec.Command(gitBin, args...)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		if err := p.run(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCloner returns a cloner that writes the charts into the clone and
+// records the repo and ref it was called with
+func fakeCloner(charts []string, cloned *string) func(repo, ref, dir string) error {
+	return func(repo, ref, dir string) error {
+		*cloned = repo + "@" + ref
+		for _, c := range charts {
+			if err := os.MkdirAll(filepath.Join(dir, c), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, c, "Chart.yaml"), []byte("name: app\n"), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestCloneChartRepo(t *testing.T) {
+	tests := []struct {
+		name       string
+		ref        string
+		charts     []string
+		cloneErr   error
+		wantCloned string
+		wantErr    string
+	}{
+		{"ref", "v1.0.0", []string{"charts/app"}, nil, "https://git.example.com/charts.git@v1.0.0", ""},
+		{"default ref", "", []string{"charts/app"}, nil, "https://git.example.com/charts.git@HEAD", ""},
+		{"chart missing", "main", []string{"charts/other"}, nil, "https://git.example.com/charts.git@main", "could not find chart charts/app in https://git.example.com/charts.git at main"},
+		{"clone fails", "main", nil, errors.New("exit status 128"), "https://git.example.com/charts.git@main", "could not clone https://git.example.com/charts.git at main: exit status 128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "clone-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+
+			var cloned string
+			p := newTestPlugin()
+			p.TempDir = tmp
+			p.GitRepo = "https://git.example.com/charts.git"
+			p.GitRef = tt.ref
+			p.ChartPath = "charts/app"
+			clone := fakeCloner(tt.charts, &cloned)
+			p.cloner = func(repo, ref, dir string) error {
+				if err := clone(repo, ref, dir); err != nil {
+					return err
+				}
+				return tt.cloneErr
+			}
+
+			dir, chart, err := p.cloneChartRepo()
+			if filepath.Dir(dir) != tmp {
+				t.Errorf("cloneChartRepo() cloned into %q, want a dir in %q", dir, tmp)
+			}
+			if cloned != tt.wantCloned {
+				t.Errorf("cloneChartRepo() cloned %q, want %q", cloned, tt.wantCloned)
+			}
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("cloneChartRepo() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cloneChartRepo() error = %v", err)
+			}
+			if want := filepath.Join(dir, "charts/app"); chart != want {
+				t.Errorf("cloneChartRepo() chart = %q, want %q", chart, want)
+			}
+		})
+	}
+}
+
+func TestDeployGitRepo(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "clone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	var cloned string
+	p := newTestPlugin()
+	p.TempDir = tmp
+	p.GitRepo = "https://git.example.com/charts.git"
+	p.GitRef = "v1.0.0"
+	p.ChartPath = "charts/app"
+	p.cloner = fakeCloner([]string{"charts/app"}, &cloned)
+
+	upgrade := deployCommand(t, p)
+	fields := strings.Fields(upgrade)
+	if len(fields) < 4 || !strings.HasPrefix(fields[3], tmp) || !strings.HasSuffix(fields[3], "/charts/app") {
+		t.Errorf("deploy ran %q, want the chart of the clone", upgrade)
+	}
+	if entries, _ := ioutil.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("deploy left %d entries in the temp dir, want the clone removed", len(entries))
+	}
+}
+
+func TestGitClone(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"git": "exit 0"})
+	defer restore()
+	dir, err := ioutil.TempDir("", "clone-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPlugin()
+	if err := p.gitClone("https://git.example.com/charts.git", "v1.0.0", dir); err != nil {
+		t.Fatalf("gitClone() error = %v", err)
+	}
+	want := []string{
+		"git init --quiet",
+		"git fetch --quiet --depth 1 https://git.example.com/charts.git v1.0.0",
+		"git checkout --quiet FETCH_HEAD",
+	}
+	if got := calls(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("gitClone() ran %q, want %q", got, want)
+	}
+}
+
+func TestCloneChartRepoPrintOnly(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"git": "exit 1"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.PrintOnly = true
+	p.GitRepo = "https://git.example.com/charts.git"
+	p.ChartPath = "charts/app"
+	var (
+		dir, chart string
+		err        error
+	)
+	lines := captureLog(func() { dir, chart, err = p.cloneChartRepo() })
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatalf("cloneChartRepo() error = %v", err)
+	}
+	if want := filepath.Join(dir, "charts/app"); chart != want {
+		t.Errorf("cloneChartRepo() chart = %q, want %q", chart, want)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("cloneChartRepo() ran %q with print only", got)
+	}
+	if !hasCall(lines, "would run: git fetch --quiet --depth 1 https://git.example.com/charts.git HEAD") {
+		t.Errorf("cloneChartRepo() logged %q, want the clone commands", lines)
+	}
+}
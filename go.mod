@@ -4,5 +4,6 @@ go 1.13
 
 require (
 	github.com/kelseyhightower/envconfig v1.3.0
+	github.com/mozilla-services/yaml v0.0.0-20191106225358-5c216288813c
 	go.mozilla.org/sops/v3 v3.5.0
 )
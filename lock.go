@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// errLockExists is returned by a lockStore if the lock object already exists
+var errLockExists = errors.New("lock exists")
+
+// lockStore creates and removes the lock objects of releases
+type lockStore interface {
+	// create uploads the file as lock object, if the object does not
+	// exist yet. Otherwise errLockExists is returned.
+	create(file, url string) error
+	// remove removes the lock object
+	remove(url string) error
+}
+
+// gsutilLocks keeps the lock objects in GCS
+type gsutilLocks struct {
+	p Plugin
+}
+
+// create uploads the lock object only if no generation of it exists.
+// gsutil -h x-goog-if-generation-match:0 cp $FILE $URL
+func (l gsutilLocks) create(file, url string) error {
+	args := append(l.p.gsutilArgs(), "-h", "x-goog-if-generation-match:0", "cp", file, url)
+	_, err := l.p.output(l.p.gsutilCommand(args...))
+	if isPreconditionFailed(err) {
+		return errLockExists
+	}
+	return err
+}
+
+// remove removes the lock object.
+// gsutil rm $URL
+func (l gsutilLocks) remove(url string) error {
+	args := append(l.p.gsutilArgs(), "rm", url)
+	_, err := l.p.output(l.p.gsutilCommand(args...))
+	return err
+}
+
+// lockObjects returns the store of the lock objects
+func (p Plugin) lockObjects() lockStore {
+	if p.locks != nil {
+		return p.locks
+	}
+	return gsutilLocks{p}
+}
+
+// lockURL returns the URL of the lock object of the release
+func (p Plugin) lockURL() string {
+	bucket := p.LockBucket
+	if bucket == "" {
+		bucket = p.Bucket
+	}
+	return fmt.Sprintf("gs://%s/locks/%s/%s.lock", bucket, p.Namespace, p.Release)
+}
+
+// acquireLock creates the lock object of the release. The object is only
+// created if it does not exist yet, so only one run can hold the lock. It is
+// retried until the LockTimeout is over.
+func (p Plugin) acquireLock() error {
+	tmp, err := ioutil.TempFile(p.tempDir(""), "lock-")
+	if err != nil {
+		return fmt.Errorf("could not create temp file for the lock: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	// the holder of the lock helps to find stale locks
+	holder := fmt.Sprintf("build %s %s\n", os.Getenv("DRONE_BUILD_NUMBER"), os.Getenv("DRONE_BUILD_LINK"))
+	if _, err := tmp.WriteString(holder); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write lock temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close the lock temp file: %w", err)
+	}
+
+	var timeout time.Duration
+	if p.LockTimeout != "" {
+		timeout, _ = time.ParseDuration(p.LockTimeout)
+	}
+	deadline := time.Now().Add(timeout)
+	locks := p.lockObjects()
+	for {
+		err := locks.create(tmp.Name(), p.lockURL())
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errLockExists) {
+			return fmt.Errorf("could not create lock %s: %w", p.lockURL(), err)
+		}
+		if time.Now().Add(updateWaitTime).After(deadline) {
+			return fmt.Errorf("release %s is locked by another run, remove %s if the lock is stale", p.Release, p.lockURL())
+		}
+		log.Printf("release %s is locked by another run, retrying in %s", p.Release, updateWaitTime)
+		time.Sleep(updateWaitTime)
+	}
+}
+
+// releaseLock removes the lock object of the release. Errors are only
+// logged, so a stale lock has to be removed manually.
+func (p Plugin) releaseLock() {
+	if err := p.lockObjects().remove(p.lockURL()); err != nil {
+		log.Printf("could not remove lock %s: %v", p.lockURL(), err)
+	}
+}
+
+// isPreconditionFailed reports whether the gsutil command failed, because
+// the object already exists. A bare 412 could as well be part of a bucket
+// name or request id.
+func isPreconditionFailed(err error) bool {
+	out := exitErrorOutput(err)
+	return strings.Contains(out, "PreconditionException") || strings.Contains(out, "412 Precondition Failed")
+}
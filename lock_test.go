@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGCS keeps the lock objects in memory
+type fakeGCS struct {
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func newFakeGCS() *fakeGCS {
+	return &fakeGCS{objects: map[string]string{}}
+}
+
+func (g *fakeGCS) create(file, url string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.objects[url]; ok {
+		return errLockExists
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	g.objects[url] = string(b)
+	return nil
+}
+
+func (g *fakeGCS) remove(url string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.objects, url)
+	return nil
+}
+
+func (g *fakeGCS) has(url string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.objects[url]
+	return ok
+}
+
+func newLockPlugin(gcs *fakeGCS) Plugin {
+	p := newTestPlugin()
+	p.Lock = true
+	p.Bucket = "charts"
+	p.locks = gcs
+	return p
+}
+
+func TestAcquireReleaseLock(t *testing.T) {
+	defer restoreEnv("DRONE_BUILD_NUMBER", "DRONE_BUILD_LINK")()
+	os.Setenv("DRONE_BUILD_NUMBER", "42")
+	os.Setenv("DRONE_BUILD_LINK", "https://drone.example.com/42")
+
+	gcs := newFakeGCS()
+	p := newLockPlugin(gcs)
+	url := "gs://charts/locks/default/app.lock"
+	if got := p.lockURL(); got != url {
+		t.Fatalf("lockURL() = %q, want %q", got, url)
+	}
+
+	if err := p.acquireLock(); err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+	if got := gcs.objects[url]; got != "build 42 https://drone.example.com/42\n" {
+		t.Errorf("lock object = %q, want the holder", got)
+	}
+	p.releaseLock()
+	if gcs.has(url) {
+		t.Errorf("releaseLock() kept the lock object")
+	}
+}
+
+func TestAcquireLockContention(t *testing.T) {
+	defer func(d time.Duration) { updateWaitTime = d }(updateWaitTime)
+	updateWaitTime = 10 * time.Millisecond
+
+	gcs := newFakeGCS()
+	holder := newLockPlugin(gcs)
+	if err := holder.acquireLock(); err != nil {
+		t.Fatalf("acquireLock() error = %v", err)
+	}
+
+	t.Run("fails fast", func(t *testing.T) {
+		p := newLockPlugin(gcs)
+		err := p.acquireLock()
+		if err == nil || !strings.HasPrefix(err.Error(), "release app is locked by another run") {
+			t.Errorf("acquireLock() error = %v, want the release to be locked", err)
+		}
+	})
+
+	t.Run("other release", func(t *testing.T) {
+		p := newLockPlugin(gcs)
+		p.Release = "other"
+		if err := p.acquireLock(); err != nil {
+			t.Errorf("acquireLock() error = %v, want the lock of another release", err)
+		}
+	})
+
+	t.Run("waits", func(t *testing.T) {
+		p := newLockPlugin(gcs)
+		p.LockTimeout = "5s"
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			holder.releaseLock()
+		}()
+		var err error
+		lines := captureLog(func() { err = p.acquireLock() })
+		if err != nil {
+			t.Fatalf("acquireLock() error = %v, want the lock after it was released", err)
+		}
+		if !strings.HasPrefix(lines[0], "release app is locked by another run, retrying") {
+			t.Errorf("acquireLock() logged %q, want the retries", lines)
+		}
+		if !gcs.has(p.lockURL()) {
+			t.Errorf("acquireLock() did not create the lock object")
+		}
+	})
+}
+
+func TestExecLock(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+	defer restore()
+
+	gcs := newFakeGCS()
+	p := newLockPlugin(gcs)
+	p.locks = lockCheck{gcs, t}
+	if err := p.Exec(); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	if gcs.has(p.lockURL()) {
+		t.Errorf("Exec() kept the lock object")
+	}
+
+	// a locked release is not deployed
+	holder := newLockPlugin(gcs)
+	if err := holder.acquireLock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := newLockPlugin(gcs).Exec(); err == nil {
+		t.Errorf("Exec() of a locked release succeeded")
+	}
+}
+
+// lockCheck fails the test if the lock is not held while removing it
+type lockCheck struct {
+	*fakeGCS
+	t *testing.T
+}
+
+func (l lockCheck) remove(url string) error {
+	if !l.has(url) {
+		l.t.Errorf("lock %s was removed without being held", url)
+	}
+	return l.fakeGCS.remove(url)
+}
+
+func TestGsutilLocks(t *testing.T) {
+	tests := []struct {
+		name    string
+		gsutil  string
+		wantErr string
+	}{
+		{"created", "exit 0", ""},
+		{"exists", "echo 'PreconditionException: 412 At least one of the pre-conditions you specified did not hold.' >&2; exit 1", errLockExists.Error()},
+		{"precondition status", "echo 'ServiceException: 412 Precondition Failed' >&2; exit 1", errLockExists.Error()},
+		{"fails", "echo 'AccessDeniedException: 403' >&2; exit 1", "exit status 1"},
+		{"fails with 412 in the output", "echo 'AccessDeniedException: 403 caller does not have access to bucket charts-412' >&2; exit 1", "exit status 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gsutil": tt.gsutil})
+			defer restore()
+
+			l := gsutilLocks{newTestPlugin()}
+			err := l.create("/tmp/lock", "gs://charts/locks/default/app.lock")
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("create() error = %v, want %q", err, tt.wantErr)
+			}
+			if got, want := calls(), "gsutil -h x-goog-if-generation-match:0 cp /tmp/lock gs://charts/locks/default/app.lock"; got[0] != want {
+				t.Errorf("create() ran %q, want %q", got[0], want)
+			}
+		})
+	}
+
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+	defer restore()
+	if err := (gsutilLocks{newTestPlugin()}).remove("gs://charts/locks/default/app.lock"); err != nil {
+		t.Errorf("remove() error = %v", err)
+	}
+	if got := calls(); len(got) != 1 || got[0] != "gsutil rm gs://charts/locks/default/app.lock" {
+		t.Errorf("remove() ran %q", got)
+	}
+}
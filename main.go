@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -11,10 +14,19 @@ import (
 )
 
 func main() {
+	// the config file is loaded first, so that the environment overrides it
+	configFile := os.Getenv("PLUGIN_CONFIG_FILE")
+	if configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			log.Fatalf("failed to load config file: %v", err)
+		}
+	}
+
 	var p Plugin
 	if err := envconfig.Process("plugin", &p); err != nil {
 		log.Fatalf("failed to parse parameters: %v", err)
 	}
+	p.ConfigFile = configFile
 	if p.ShowEnv {
 		for _, e := range os.Environ() {
 			pair := strings.Split(e, "=")
@@ -32,12 +44,11 @@ func main() {
 }
 
 func preparePlugin(p *Plugin) error {
-	if p.Package == "" {
-		s := strings.Split(p.ChartPath, "/")
-		p.Package = s[len(s)-1]
-	}
-	if p.Release == "" {
-		p.Release = p.Package
+	setChartDefaults(p)
+	if os.Getenv("PLUGIN_DELETE_TEST_NAMESPACE") != "" {
+		// the test namespace is never created by the plugin, so there is
+		// nothing it could clean up
+		log.Printf("warning: delete_test_namespace is not supported, the plugin does not create the test namespace")
 	}
 	if p.ChartRepo == "" && p.Bucket != "" {
 		p.ChartRepo = fmt.Sprintf("https://%s.storage.googleapis.com/", p.Bucket)
@@ -46,26 +57,198 @@ func preparePlugin(p *Plugin) error {
 		p.Namespace = "default"
 	}
 
+	if p.LogFile != "" {
+		f, err := os.OpenFile(p.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open log file: %v", err)
+		}
+		// the file is closed when the plugin exits, the log and the commands
+		// write to it through the same lock
+		p.logWriter = &lockedWriter{w: f}
+		log.SetOutput(io.MultiWriter(os.Stderr, p.logWriter))
+	}
+
+	if p.TempDir != "" {
+		if err := os.MkdirAll(p.TempDir, 0700); err != nil {
+			return fmt.Errorf("could not create temp dir: %v", err)
+		}
+	}
+
 	if p.AuthKey != "" {
-		tmpfile, err := ioutil.TempFile("", "auth-key.json")
+		keyPath, err := writeKeyFile(p.tempDir(""), p.AuthKey)
 		if err != nil {
-			return fmt.Errorf("could not create temporary file for the auth key: %v", err)
+			return fmt.Errorf("could not write the auth key: %v", err)
+		}
+		p.KeyPath = keyPath
+	}
+
+	if p.GcloudConfigDir != "" {
+		if err := os.MkdirAll(p.GcloudConfigDir, 0700); err != nil {
+			return fmt.Errorf("could not create gcloud config dir: %v", err)
+		}
+		// CLOUDSDK_CONFIG isolates the gcloud state used by setupAuth and setupProject
+		if err := os.Setenv("CLOUDSDK_CONFIG", p.GcloudConfigDir); err != nil {
+			return fmt.Errorf("could not set CLOUDSDK_CONFIG env variable: %v", err)
 		}
+	}
 
-		if _, err := tmpfile.Write([]byte(p.AuthKey)); err != nil {
-			return fmt.Errorf("could not write to temporary auth key file: %v", err)
+	// the proxy settings are used by all gcloud, gsutil, kubectl and helm commands
+	proxies := []struct{ name, value string }{
+		{"HTTPS_PROXY", p.HTTPSProxy},
+		{"HTTP_PROXY", p.HTTPProxy},
+		{"NO_PROXY", p.NoProxy},
+	}
+	for _, e := range proxies {
+		if e.value == "" {
+			continue
 		}
-		if err := tmpfile.Close(); err != nil {
-			return fmt.Errorf("could not close the temporary auth key file: %v", err)
+		for _, name := range []string{e.name, strings.ToLower(e.name)} {
+			if err := os.Setenv(name, e.value); err != nil {
+				return fmt.Errorf("could not set %s env variable: %v", name, err)
+			}
 		}
-		p.KeyPath = tmpfile.Name()
 	}
 
-	if p.KeyPath != "" {
-		if err := setupAuth(p.KeyPath, p.Debug); err != nil {
+	if p.RequestReason == "" {
+		p.RequestReason = os.Getenv("DRONE_BUILD_NUMBER")
+	}
+	if p.RequestReason != "" {
+		// sent by gcloud as X-Goog-Request-Reason header
+		if err := os.Setenv("CLOUDSDK_CORE_REQUEST_REASON", p.RequestReason); err != nil {
+			return fmt.Errorf("could not set CLOUDSDK_CORE_REQUEST_REASON env variable: %v", err)
+		}
+	}
+
+	// the helm homes are used by all helm commands, also by selectHelm
+	homes := []struct{ name, dir string }{
+		{"HELM_DATA_HOME", p.HelmDataHome},
+		{"HELM_CACHE_HOME", p.HelmCacheHome},
+		{"HELM_CONFIG_HOME", p.HelmConfigHome},
+	}
+	for _, h := range homes {
+		if h.dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(h.dir, 0700); err != nil {
+			return fmt.Errorf("could not create %s: %v", h.name, err)
+		}
+		if err := os.Setenv(h.name, h.dir); err != nil {
+			return fmt.Errorf("could not set %s env variable: %v", h.name, err)
+		}
+	}
+
+	if p.noColor() {
+		// disables the colors of helm plugins like helm-diff
+		if err := os.Setenv("HELM_DIFF_COLOR", "false"); err != nil {
+			return fmt.Errorf("could not set HELM_DIFF_COLOR env variable: %v", err)
+		}
+	}
+
+	if err := p.selectHelm(); err != nil {
+		return err
+	}
+
+	if p.BotoConfig != "" {
+		if _, err := os.Stat(p.BotoConfig); err != nil {
+			return fmt.Errorf("could not find boto config: %v", err)
+		}
+		if err := os.Setenv("BOTO_CONFIG", p.BotoConfig); err != nil {
+			return fmt.Errorf("could not set BOTO_CONFIG env variable: %v", err)
+		}
+	}
+
+	if p.BucketAuthKey != "" {
+		if err := setupBucketAuth(p); err != nil {
+			return fmt.Errorf("could not setup bucket auth: %v", err)
+		}
+	}
+
+	if p.InCluster {
+		// helm and kubectl fall back to the service account of the pod
+		// without a kubeconfig, gcloud is not used at all
+		if os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+			log.Printf("warning: in cluster is set, but KUBERNETES_SERVICE_HOST is not, the plugin might not run in a cluster")
+		}
+	} else if p.KeyPath != "" {
+		if err := p.setupAuth(); err != nil {
 			return fmt.Errorf("could not setup auth: %v", err)
 		}
 	}
 
 	return nil
 }
+
+// setChartDefaults defaults the package, chart version and release of the chart
+func setChartDefaults(p *Plugin) {
+	// the Chart.yaml is authoritative, but the chart might not exist locally
+	var chartName string
+	if chart, err := readChartFile(p.ChartPath); err == nil {
+		chartName = chart.Name
+		if p.ChartVersion == "" {
+			p.ChartVersion = chart.Version
+		}
+	}
+	// the release keeps defaulting to the package given or the directory of
+	// the chart, a new default would install a second copy of the release
+	s := strings.Split(p.ChartPath, "/")
+	dirName := s[len(s)-1]
+	if p.Release == "" && !p.GenerateName {
+		p.Release = p.Package
+		if p.Release == "" {
+			p.Release = dirName
+			if chartName != "" && chartName != dirName {
+				log.Printf("warning: release defaults to the chart directory '%s', not to the chart name '%s', set release to be explicit", dirName, chartName)
+			}
+		}
+	}
+	if p.Package == "" {
+		p.Package = chartName
+	}
+	if p.Package == "" {
+		p.Package = dirName
+	}
+}
+
+// writeKeyFile writes the service account key to a temporary file in dir
+func writeKeyFile(dir, key string) (string, error) {
+	tmpfile, err := ioutil.TempFile(dir, "auth-key.json")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %v", err)
+	}
+	if _, err := tmpfile.Write([]byte(key)); err != nil {
+		tmpfile.Close()
+		return "", fmt.Errorf("could not write to temporary file: %v", err)
+	}
+	if err := tmpfile.Close(); err != nil {
+		return "", fmt.Errorf("could not close the temporary file: %v", err)
+	}
+	return tmpfile.Name(), nil
+}
+
+// setupBucketAuth activates the service account of the BucketAuthKey in a
+// gcloud config dir of its own. Only gsutil uses the config dir, so the
+// active account of all other commands is not changed.
+func setupBucketAuth(p *Plugin) error {
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal([]byte(p.BucketAuthKey), &key); err != nil || key.ClientEmail == "" {
+		return errors.New("bucket auth key is not a service account key")
+	}
+
+	keyPath, err := writeKeyFile(p.tempDir(""), p.BucketAuthKey)
+	if err != nil {
+		return fmt.Errorf("could not write the bucket auth key: %v", err)
+	}
+	dir, err := ioutil.TempDir(p.tempDir(""), "gsutil-config-")
+	if err != nil {
+		return fmt.Errorf("could not create the gsutil config dir: %v", err)
+	}
+	cmd := p.gcloudCommand("auth", "activate-service-account", fmt.Sprintf("--key-file=%s", keyPath))
+	cmd.Env = append(os.Environ(), "CLOUDSDK_CONFIG="+dir)
+	if err := p.run(cmd); err != nil {
+		return fmt.Errorf("could not authorize with gcloud: %w", err)
+	}
+	p.bucketConfigDir = dir
+	return nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPreparePlugin returns a test plugin which preparePlugin does not change
+// the environment for, beside the tested parameters
+func newPreparePlugin() Plugin {
+	p := newTestPlugin()
+	noColor := false
+	p.NoColor = &noColor
+	return p
+}
+
+// restoreEnv returns a func which resets the env variables to their current values
+func restoreEnv(names ...string) func() {
+	values := map[string]*string{}
+	for _, n := range names {
+		if v, ok := os.LookupEnv(n); ok {
+			values[n] = &v
+		} else {
+			values[n] = nil
+		}
+	}
+	return func() {
+		for n, v := range values {
+			if v == nil {
+				os.Unsetenv(n)
+			} else {
+				os.Setenv(n, *v)
+			}
+		}
+	}
+}
+
+func TestPrepareBotoConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boto-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boto := filepath.Join(dir, "boto.cfg")
+	if err := ioutil.WriteFile(boto, []byte("[GSUtil]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer restoreEnv("BOTO_CONFIG")()
+
+	p := newPreparePlugin()
+	p.BotoConfig = boto
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	if got := os.Getenv("BOTO_CONFIG"); got != boto {
+		t.Errorf("BOTO_CONFIG = %q, want %q", got, boto)
+	}
+
+	p = newPreparePlugin()
+	p.BotoConfig = filepath.Join(dir, "missing.cfg")
+	if err := preparePlugin(&p); err == nil {
+		t.Error("preparePlugin() succeeded with a missing boto config")
+	}
+}
+
+func TestPrepareGcloudConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcloud-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreEnv("CLOUDSDK_CONFIG")()
+
+	p := newPreparePlugin()
+	p.GcloudConfigDir = filepath.Join(dir, "config")
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	if got := os.Getenv("CLOUDSDK_CONFIG"); got != p.GcloudConfigDir {
+		t.Errorf("CLOUDSDK_CONFIG = %q, want %q", got, p.GcloudConfigDir)
+	}
+	if fi, err := os.Stat(p.GcloudConfigDir); err != nil || !fi.IsDir() {
+		t.Errorf("gcloud config dir was not created: %v", err)
+	}
+}
+
+func TestPrepareRequestReason(t *testing.T) {
+	defer restoreEnv("CLOUDSDK_CORE_REQUEST_REASON", "DRONE_BUILD_NUMBER")()
+	os.Setenv("DRONE_BUILD_NUMBER", "42")
+
+	tests := []struct {
+		reason string
+		want   string
+	}{
+		{"release-1.2", "release-1.2"},
+		{"", "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			p := newPreparePlugin()
+			p.RequestReason = tt.reason
+			if err := preparePlugin(&p); err != nil {
+				t.Fatalf("preparePlugin() error = %v", err)
+			}
+			if got := os.Getenv("CLOUDSDK_CORE_REQUEST_REASON"); got != tt.want {
+				t.Errorf("CLOUDSDK_CORE_REQUEST_REASON = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareProxies(t *testing.T) {
+	names := []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"}
+	defer restoreEnv(names...)()
+	for _, n := range names {
+		os.Unsetenv(n)
+	}
+
+	p := newPreparePlugin()
+	p.HTTPSProxy = "http://proxy:3128"
+	p.NoProxy = "metadata.google.internal"
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	want := map[string]string{
+		"HTTPS_PROXY": "http://proxy:3128",
+		"https_proxy": "http://proxy:3128",
+		"HTTP_PROXY":  "",
+		"http_proxy":  "",
+		"NO_PROXY":    "metadata.google.internal",
+		"no_proxy":    "metadata.google.internal",
+	}
+	for n, v := range want {
+		if got := os.Getenv(n); got != v {
+			t.Errorf("%s = %q, want %q", n, got, v)
+		}
+	}
+
+	// the commands inherit the proxy settings
+	calls, restore := fakeCommands(t, map[string]string{"kubectl": `echo "proxy $HTTPS_PROXY" >> "$FAKE_DIR/calls"`})
+	defer restore()
+	if _, err := p.createNamespace("default"); err != nil {
+		t.Fatalf("createNamespace() error = %v", err)
+	}
+	if !hasCall(calls(), "proxy http://proxy:3128") {
+		t.Errorf("kubectl did not get the proxy: %q", calls())
+	}
+}
+
+func TestSetChartDefaults(t *testing.T) {
+	parent, err := ioutil.TempDir("", "charts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	// the chart my-app lives in the directory web
+	web := filepath.Join(parent, "web")
+	myApp := filepath.Join(parent, "my-app")
+	for _, dir := range []string{web, myApp} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte("name: my-app\nversion: 2.1.0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name                              string
+		chartPath                         string
+		pkg, version, release             string
+		wantPkg, wantVersion, wantRelease string
+		wantWarn                          bool
+	}{
+		{"chart file", myApp, "", "", "", "my-app", "2.1.0", "my-app", false},
+		{"directory differs from chart", web, "", "", "", "my-app", "2.1.0", "web", true},
+		{"package", web, "other", "", "", "other", "2.1.0", "other", false},
+		{"overrides", web, "other", "3.0.0", "prod", "other", "3.0.0", "prod", false},
+		{"no chart file", filepath.Join("charts", "web"), "", "", "", "web", "", "web", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Plugin{ChartPath: tt.chartPath, Package: tt.pkg, ChartVersion: tt.version, Release: tt.release}
+			lines := captureLog(func() { setChartDefaults(&p) })
+			if p.Package != tt.wantPkg || p.ChartVersion != tt.wantVersion || p.Release != tt.wantRelease {
+				t.Errorf("setChartDefaults() = %q, %q, %q, want %q, %q, %q", p.Package, p.ChartVersion, p.Release, tt.wantPkg, tt.wantVersion, tt.wantRelease)
+			}
+			if warned := len(lines) > 0 && strings.HasPrefix(lines[0], "warning: release defaults to the chart directory"); warned != tt.wantWarn {
+				t.Errorf("setChartDefaults() logged %q, want warning %v", lines, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestPrepareDeleteTestNamespace(t *testing.T) {
+	defer restoreEnv("PLUGIN_DELETE_TEST_NAMESPACE")()
+	for _, set := range []bool{false, true} {
+		os.Unsetenv("PLUGIN_DELETE_TEST_NAMESPACE")
+		if set {
+			os.Setenv("PLUGIN_DELETE_TEST_NAMESPACE", "true")
+		}
+		p := newPreparePlugin()
+		var err error
+		lines := captureLog(func() { err = preparePlugin(&p) })
+		if err != nil {
+			t.Fatalf("preparePlugin() error = %v", err)
+		}
+		if warned := hasCall(lines, "warning: delete_test_namespace is not supported"); warned != set {
+			t.Errorf("preparePlugin() with delete_test_namespace %v logged %q", set, lines)
+		}
+	}
+}
+
+func TestPrepareNoColor(t *testing.T) {
+	defer restoreEnv("HELM_DIFF_COLOR")()
+	for _, noColor := range []bool{false, true} {
+		os.Unsetenv("HELM_DIFF_COLOR")
+		p := newPreparePlugin()
+		p.NoColor = &noColor
+		if err := preparePlugin(&p); err != nil {
+			t.Fatalf("preparePlugin() error = %v", err)
+		}
+		if got, want := os.Getenv("HELM_DIFF_COLOR"), map[bool]string{true: "false"}[noColor]; got != want {
+			t.Errorf("HELM_DIFF_COLOR with no color %v = %q, want %q", noColor, got, want)
+		}
+	}
+}
+
+func TestPrepareInCluster(t *testing.T) {
+	defer restoreEnv("KUBERNETES_SERVICE_HOST")()
+	calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+	defer restore()
+
+	tests := []struct {
+		host     string
+		wantWarn bool
+	}{
+		{"10.0.0.1", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		os.Setenv("KUBERNETES_SERVICE_HOST", tt.host)
+		p := newPreparePlugin()
+		p.InCluster = true
+		p.KeyPath = "key.json"
+		var err error
+		lines := captureLog(func() { err = preparePlugin(&p) })
+		if err != nil {
+			t.Fatalf("preparePlugin() error = %v", err)
+		}
+		if warned := strings.HasPrefix(lines[0], "warning: in cluster"); warned != tt.wantWarn {
+			t.Errorf("preparePlugin() with KUBERNETES_SERVICE_HOST %q logged %q", tt.host, lines)
+		}
+	}
+	// the service account of the pod is used instead of the key
+	if got := calls(); len(got) != 0 {
+		t.Errorf("gcloud was run in cluster: %q", got)
+	}
+}
+
+func TestPrepareTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "temp-dir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreEnv("GOOGLE_APPLICATION_CREDENTIALS")()
+	calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+	defer restore()
+
+	p := newPreparePlugin()
+	p.TempDir = filepath.Join(dir, "tmp")
+	p.AuthKey = `{"client_email":"deploy@project.iam.gserviceaccount.com"}`
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	if fi, err := os.Stat(p.TempDir); err != nil || !fi.IsDir() {
+		t.Fatalf("temp dir was not created: %v", err)
+	}
+	// the key is written to the temp dir
+	if filepath.Dir(p.KeyPath) != p.TempDir {
+		t.Errorf("key file %s is not in the temp dir %s", p.KeyPath, p.TempDir)
+	}
+	if b, _ := ioutil.ReadFile(p.KeyPath); string(b) != p.AuthKey {
+		t.Errorf("key file = %q, want the auth key", b)
+	}
+	if got := calls(); len(got) != 1 || got[0] != "gcloud auth activate-service-account --key-file="+p.KeyPath {
+		t.Errorf("gcloud calls = %q, want the activation of the key", got)
+	}
+}
+
+func TestPrepareBucketAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucket-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreEnv("CLOUDSDK_CONFIG", "GOOGLE_APPLICATION_CREDENTIALS")()
+	os.Unsetenv("CLOUDSDK_CONFIG")
+	// the fakes keep the activated key in the config dir like gcloud does
+	calls, restore := fakeCommands(t, map[string]string{
+		"gcloud": `config="${CLOUDSDK_CONFIG:-$FAKE_DIR/default}"
+case "$1 $2" in
+"auth activate-service-account") mkdir -p "$config"; cat "${3#--key-file=}" > "$config/active" ;;
+*) echo "active: $(cat "$config/active")" >> "$FAKE_DIR/calls" ;;
+esac`,
+		"gsutil": `echo "active: $(cat "$CLOUDSDK_CONFIG/active")" >> "$FAKE_DIR/calls"`,
+	})
+	defer restore()
+
+	p := newPreparePlugin()
+	p.TempDir = dir
+	p.AuthKey = `{"client_email":"deploy@project.iam.gserviceaccount.com"}`
+	p.BucketAuthKey = `{"client_email":"charts@other.iam.gserviceaccount.com"}`
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	if err := p.cpPackage("gs://charts/app-1.0.0.tgz", "app-1.0.0.tgz"); err != nil {
+		t.Fatalf("cpPackage() error = %v", err)
+	}
+	if err := p.run(p.gcloudCommand("container", "clusters", "list")); err != nil {
+		t.Fatalf("gcloud error = %v", err)
+	}
+
+	var active []string
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "active: ") {
+			active = append(active, c)
+		}
+	}
+	want := []string{
+		"active: " + p.BucketAuthKey,
+		"active: " + p.AuthKey,
+	}
+	if strings.Join(active, "\n") != strings.Join(want, "\n") {
+		t.Errorf("active keys of gsutil and gcloud = %q, want %q", active, want)
+	}
+	if !strings.HasPrefix(p.bucketConfigDir, dir) {
+		t.Errorf("gsutil config dir %s is not in the temp dir", p.bucketConfigDir)
+	}
+
+	p = newPreparePlugin()
+	p.BucketAuthKey = `{"type":"authorized_user"}`
+	if err := preparePlugin(&p); err == nil {
+		t.Error("preparePlugin() accepted a bucket auth key without client email")
+	}
+}
+
+func TestPrepareLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-file-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "deploy.log")
+	if err := ioutil.WriteFile(logFile, []byte("previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer log.SetOutput(os.Stderr)
+
+	p := newPreparePlugin()
+	p.LogFile = logFile
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	defer p.logWriter.w.(*os.File).Close()
+	log.Print("deploying app")
+
+	b, _ := ioutil.ReadFile(logFile)
+	if !strings.HasPrefix(string(b), "previous run\n") || !strings.HasSuffix(string(b), "deploying app\n") {
+		t.Errorf("log file = %q, want the log appended to the previous run", b)
+	}
+
+	// the log waits for the lock the commands write the log file with
+	p.logWriter.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		log.Print("waiting")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Error("log was written without the lock of the log file")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.logWriter.mu.Unlock()
+	<-done
+}
+
+func TestPrepareHelmHomes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm-homes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreEnv("HELM_DATA_HOME", "HELM_CACHE_HOME", "HELM_CONFIG_HOME")()
+	os.Setenv("HELM_CONFIG_HOME", "/etc/helm")
+
+	p := newPreparePlugin()
+	p.HelmDataHome = filepath.Join(dir, "data")
+	p.HelmCacheHome = filepath.Join(dir, "cache", "helm")
+	if err := preparePlugin(&p); err != nil {
+		t.Fatalf("preparePlugin() error = %v", err)
+	}
+	for name, want := range map[string]string{
+		"HELM_DATA_HOME":   p.HelmDataHome,
+		"HELM_CACHE_HOME":  p.HelmCacheHome,
+		"HELM_CONFIG_HOME": "/etc/helm",
+	} {
+		if got := os.Getenv(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, d := range []string{p.HelmDataHome, p.HelmCacheHome} {
+		if fi, err := os.Stat(d); err != nil || !fi.IsDir() {
+			t.Errorf("helm home %s was not created: %v", d, err)
+		}
+	}
+
+	// the homes are passed to the helm commands
+	calls, restore := fakeCommands(t, map[string]string{"helm": `echo "homes: $HELM_DATA_HOME $HELM_CACHE_HOME" >> "$FAKE_DIR/calls"`})
+	defer restore()
+	if err := p.lintPackage(); err != nil {
+		t.Fatalf("lintPackage() error = %v", err)
+	}
+	if want := "homes: " + p.HelmDataHome + " " + p.HelmCacheHome; !hasCall(calls(), want) {
+		t.Errorf("helm ran with %q, want %q", calls(), want)
+	}
+}
+
+func TestPrepareHelmHomeNotWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm-homes-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer restoreEnv("HELM_DATA_HOME")()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPreparePlugin()
+	p.HelmDataHome = filepath.Join(file, "data")
+	if err := preparePlugin(&p); err == nil || !strings.HasPrefix(err.Error(), "could not create HELM_DATA_HOME") {
+		t.Errorf("preparePlugin() error = %v, want the creation of the data home to fail", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// masked are the secret values that must not show up in logs
+var masked struct {
+	sync.Mutex
+	values []string
+}
+
+// mask registers the secret value to be masked in logged command lines
+func mask(value string) {
+	if value == "" {
+		return
+	}
+	masked.Lock()
+	defer masked.Unlock()
+	masked.values = append(masked.values, value)
+}
+
+// maskQuoted registers the secret value and the escaped form it has inside a
+// shellQuote'd argument, which is the form logged command lines contain
+func maskQuoted(value string) {
+	mask(value)
+	if q := shellQuote(value); q[1:len(q)-1] != value {
+		mask(q[1 : len(q)-1])
+	}
+}
+
+// sanitize replaces all masked secret values in s
+func sanitize(s string) string {
+	masked.Lock()
+	defer masked.Unlock()
+	for _, v := range masked.values {
+		s = strings.Replace(s, v, "****", -1)
+	}
+	return s
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// resetMasked removes the values masked by a test
+func resetMasked() func() {
+	masked.Lock()
+	values := masked.values
+	masked.Unlock()
+	return func() {
+		masked.Lock()
+		masked.values = values
+		masked.Unlock()
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	defer resetMasked()()
+
+	mask("s3cret")
+	mask("t0ken")
+	mask("")
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"helm upgrade app chart", "helm upgrade app chart"},
+		{"--set-string 'password=s3cret'", "--set-string 'password=****'"},
+		{"a=s3cret,b=s3cret,c=t0ken", "a=****,b=****,c=****"},
+	}
+	for _, tt := range tests {
+		if got := sanitize(tt.in); got != tt.want {
+			t.Errorf("sanitize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMaskQuoted(t *testing.T) {
+	defer resetMasked()()
+
+	maskQuoted("it's-s3cret")
+	for _, in := range []string{"it's-s3cret", "--set-string " + shellQuote("db.pw=it's-s3cret")} {
+		if got := sanitize(in); strings.Contains(got, "s3cret") {
+			t.Errorf("sanitize(%q) = %q, want the secret masked", in, got)
+		}
+	}
+}
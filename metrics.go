@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// writeMetrics writes the results of the run in the Prometheus textfile
+// format to file.
+func writeMetrics(file string, results []ActionResult, success bool) error {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "# HELP drone_helm_action_duration_seconds Duration of the action in seconds.")
+	fmt.Fprintln(&b, "# TYPE drone_helm_action_duration_seconds gauge")
+	for _, r := range results {
+		fmt.Fprintf(&b, "drone_helm_action_duration_seconds{action=%q,chart=%q} %g\n", r.Action, r.Chart, r.Duration.Seconds())
+	}
+
+	var succeeded, warned, failed int
+	for _, r := range results {
+		switch {
+		case !r.Success:
+			failed++
+		case r.Warning:
+			warned++
+		default:
+			succeeded++
+		}
+	}
+	fmt.Fprintln(&b, "# HELP drone_helm_actions_total Number of executed actions by status.")
+	fmt.Fprintln(&b, "# TYPE drone_helm_actions_total counter")
+	fmt.Fprintf(&b, "drone_helm_actions_total{status=\"success\"} %d\n", succeeded)
+	fmt.Fprintf(&b, "drone_helm_actions_total{status=\"warning\"} %d\n", warned)
+	fmt.Fprintf(&b, "drone_helm_actions_total{status=\"failed\"} %d\n", failed)
+
+	fmt.Fprintln(&b, "# HELP drone_helm_run_success Whether the whole run succeeded.")
+	fmt.Fprintln(&b, "# TYPE drone_helm_run_success gauge")
+	fmt.Fprintf(&b, "drone_helm_run_success %d\n", boolToInt(success))
+
+	return ioutil.WriteFile(file, []byte(b.String()), 0644)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
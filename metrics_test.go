@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metrics.prom")
+
+	results := []ActionResult{
+		newActionResult(lintPkg, "chart", 1500*time.Millisecond, nil),
+		newActionResult(lintPkg, "chart", time.Second, &actionWarning{msg: "warnings"}),
+		newActionResult(deployPkg, "chart", 30*time.Second, errors.New("timed out")),
+	}
+	if err := writeMetrics(file, results, false); err != nil {
+		t.Fatalf("writeMetrics() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`drone_helm_action_duration_seconds{action="lint",chart="chart"} 1.5`,
+		`drone_helm_action_duration_seconds{action="deploy",chart="chart"} 30`,
+		`drone_helm_actions_total{status="success"} 1`,
+		`drone_helm_actions_total{status="warning"} 1`,
+		`drone_helm_actions_total{status="failed"} 1`,
+		`drone_helm_run_success 0`,
+	} {
+		if !strings.Contains(string(b), want+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestExecMetricsSetupFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, restore := fakeCommands(t, map[string]string{"gcloud": "exit 1"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Project = "project"
+	p.Cluster = "cluster"
+	p.Zone = "europe-west1-b"
+	p.MetricsFile = filepath.Join(dir, "metrics.prom")
+	if err := p.Exec(); err == nil {
+		t.Fatal("Exec() error = nil, want the setup failure")
+	}
+	b, err := ioutil.ReadFile(p.MetricsFile)
+	if err != nil {
+		t.Fatalf("metrics file was not written: %v", err)
+	}
+	if !strings.Contains(string(b), "drone_helm_run_success 0\n") {
+		t.Errorf("metrics do not report the failed run:\n%s", b)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const namespacePlaceholder = "{namespace}"
+
+// forNamespace returns a copy of the plugin deploying to the namespace.
+// The {namespace} placeholder in the secret files and the audit file is
+// replaced, so every namespace can decrypt its own secrets and writes its
+// own audit file.
+func (p Plugin) forNamespace(ns string) Plugin {
+	p.Namespaces = nil
+	p.Namespace = ns
+	secrets := make([]string, len(p.Secrets))
+	for i, s := range p.Secrets {
+		secrets[i] = strings.Replace(s, namespacePlaceholder, ns, -1)
+	}
+	p.Secrets = secrets
+	p.AuditFile = strings.Replace(p.AuditFile, namespacePlaceholder, ns, -1)
+	return p
+}
+
+// deployNamespaces deploys the release to all namespaces in parallel, at
+// most Parallelism at a time. All namespaces are deployed, also if some
+// fail, and the failures are returned together.
+func (p Plugin) deployNamespaces() error {
+	parallelism := p.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+		sem    = make(chan struct{}, parallelism)
+	)
+	for _, ns := range p.Namespaces {
+		wg.Add(1)
+		go func(np Plugin) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			if err := np.deployPackage(); err != nil {
+				mu.Lock()
+				failed = append(failed, fmt.Sprintf("namespace %s: %v", np.Namespace, err))
+				mu.Unlock()
+			}
+		}(p.forNamespace(ns))
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("could not deploy to %d of %d namespaces: %s", len(failed), len(p.Namespaces), strings.Join(failed, "; "))
+	}
+	return nil
+}
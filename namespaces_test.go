@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestForNamespace(t *testing.T) {
+	p := newTestPlugin()
+	p.Namespaces = []string{"staging", "prod"}
+	p.Secrets = []string{"secrets/{namespace}.yaml", "secrets/common.yaml"}
+	p.AuditFile = "audit/{namespace}.yaml"
+
+	np := p.forNamespace("prod")
+	if np.Namespace != "prod" || np.Namespaces != nil {
+		t.Errorf("forNamespace() namespace = %q, namespaces = %q, want only prod", np.Namespace, np.Namespaces)
+	}
+	if got, want := strings.Join(np.Secrets, ","), "secrets/prod.yaml,secrets/common.yaml"; got != want {
+		t.Errorf("forNamespace() secrets = %q, want %q", got, want)
+	}
+	if got, want := np.AuditFile, "audit/prod.yaml"; got != want {
+		t.Errorf("forNamespace() audit file = %q, want %q", got, want)
+	}
+	if got := p.Secrets[0]; got != "secrets/{namespace}.yaml" {
+		t.Errorf("forNamespace() changed the secrets of the plugin to %q", got)
+	}
+}
+
+func TestValidateNamespacesAuditFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		auditFile  string
+		wantErr    bool
+	}{
+		{"placeholder", []string{"staging", "prod"}, "audit/{namespace}.yaml", false},
+		{"shared file", []string{"staging", "prod"}, "audit.yaml", true},
+		{"one namespace", []string{"prod"}, "audit.yaml", false},
+		{"no namespaces", nil, "audit.yaml", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Namespaces = tt.namespaces
+			p.AuditFile = tt.auditFile
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// concurrentHelm is a fake helm which records the number of concurrently
+// running upgrades and fails for the namespaces starting with bad
+const concurrentHelm = `[ "$1" = upgrade ] || exit 0
+mkdir "$FAKE_DIR/running-$$"
+echo "running: $(ls -d "$FAKE_DIR"/running-* | wc -l)" >> "$FAKE_DIR/calls"
+sleep 0.2
+rmdir "$FAKE_DIR/running-$$"
+case "$*" in
+*"--namespace bad"*) echo 'Error: UPGRADE FAILED' >&2; exit 1 ;;
+esac`
+
+func TestDeployNamespaces(t *testing.T) {
+	tests := []struct {
+		name        string
+		namespaces  []string
+		parallelism int
+		wantErr     string
+	}{
+		{"sequential", []string{"ns1", "ns2", "ns3"}, 1, ""},
+		{"parallel", []string{"ns1", "ns2", "ns3", "ns4", "ns5"}, 2, ""},
+		{"failures", []string{"bad2", "ns1", "bad1", "ns2"}, 4, "could not deploy to 2 of 4 namespaces: namespace bad1: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    concurrentHelm,
+				"kubectl": `[ "$1" = rollout ] && echo 'deployment "app" successfully rolled out'; exit 0`,
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Namespaces = tt.namespaces
+			p.Parallelism = tt.parallelism
+			err := p.deployNamespaces()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Fatalf("deployNamespaces() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.wantErr != "" && !strings.Contains(err.Error(), "; namespace bad2: ") {
+				t.Errorf("deployNamespaces() error = %v, want the failures of all namespaces", err)
+			}
+
+			got := calls()
+			for _, ns := range tt.namespaces {
+				if !hasCallContaining(got, "helm upgrade", "--namespace "+ns) {
+					t.Errorf("release was not deployed to %s: %q", ns, got)
+				}
+			}
+			max := maxRunning(t, got)
+			if max > tt.parallelism {
+				t.Errorf("%d upgrades ran concurrently, want at most %d", max, tt.parallelism)
+			}
+			if tt.parallelism > 1 && max < 2 {
+				t.Errorf("upgrades ran sequentially with parallelism %d", tt.parallelism)
+			}
+		})
+	}
+}
+
+// hasCallContaining reports whether one of the calls starts with prefix and
+// contains s
+func hasCallContaining(calls []string, prefix, s string) bool {
+	for _, c := range calls {
+		if strings.HasPrefix(c, prefix) && strings.Contains(c+" ", s+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRunning returns the maximum of the concurrently running upgrades
+// recorded by concurrentHelm
+func maxRunning(t *testing.T, calls []string) int {
+	t.Helper()
+	var max int
+	for _, c := range calls {
+		if !strings.HasPrefix(c, "running: ") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(c, "running: ")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
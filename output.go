@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// writeOutputEnv writes the resolved release parameters as KEY=value lines
+// to the OutputEnvFile, so later pipeline steps can consume them.
+func (p Plugin) writeOutputEnv() error {
+	vars := [][2]string{
+		{"RELEASE", p.Release},
+		{"NAMESPACE", p.Namespace},
+		{"CHART_VERSION", p.ChartVersion},
+		{"PACKAGE", p.Package},
+	}
+
+	var b strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&b, "%s=%s\n", v[0], v[1])
+	}
+	return ioutil.WriteFile(p.OutputEnvFile, []byte(b.String()), 0644)
+}
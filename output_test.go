@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteOutputEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPlugin()
+	p.OutputEnvFile = filepath.Join(dir, "output.env")
+	p.Release = "app-canary"
+	p.Namespace = "staging"
+	p.ChartVersion = "1.2.3"
+	if err := p.writeOutputEnv(); err != nil {
+		t.Fatalf("writeOutputEnv() error = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(p.OutputEnvFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "RELEASE=app-canary\nNAMESPACE=staging\nCHART_VERSION=1.2.3\nPACKAGE=app\n"
+	if string(b) != want {
+		t.Errorf("output env file = %q, want %q", b, want)
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	sops_decrypt "go.mozilla.org/sops/v3/decrypt"
@@ -17,36 +28,161 @@ import (
 
 // Plugin defines the Helm plugin parameters.
 type Plugin struct {
-	Debug          bool     `envconfig:"DEBUG"`
-	ShowEnv        bool     `envconfig:"SHOW_ENV"`
-	Wait           bool     `envconfig:"WAIT"`
-	Recreate       bool     `envconfig:"RECREATE_PODS" default:"false"`
-	WaitTimeout    uint32   `envconfig:"WAIT_TIMEOUT" default:"300"`
-	Actions        []string `envconfig:"ACTIONS" required:"true"`
-	AuthKey        string   `envconfig:"AUTH_KEY"`
-	KeyPath        string   `envconfig:"KEY_PATH"`
-	Zone           string   `envconfig:"ZONE"`
-	Region         string   `envconfig:"REGION"`
-	Cluster        string   `envconfig:"CLUSTER"`
-	Project        string   `envconfig:"PROJECT"`
-	Namespace      string   `envconfig:"NAMESPACE"`
-	ChartRepo      string   `envconfig:"CHART_REPO"`
-	Bucket         string   `envconfig:"BUCKET"`
-	ChartPath      string   `envconfig:"CHART_PATH" required:"true"`
-	ChartVersion   string   `envconfig:"CHART_VERSION"`
-	Release        string   `envconfig:"RELEASE"`
-	Package        string   `envconfig:"PACKAGE"`
-	Values         []string `envconfig:"VALUES"`
-	ValueFiles     []string `envconfig:"VALUE_FILES"`
-	Secrets        []string `envconfig:"SECRETS"`
-	HelmStableRepo string   `envconfig:"HELM_STABLE_REPO" default:"https://charts.helm.sh/stable"`
+	Debug                        bool        `envconfig:"DEBUG"`
+	ShowEnv                      bool        `envconfig:"SHOW_ENV"`
+	Wait                         bool        `envconfig:"WAIT"`
+	Recreate                     bool        `envconfig:"RECREATE_PODS" default:"false"`
+	WaitTimeout                  uint32      `envconfig:"WAIT_TIMEOUT" default:"300"`
+	Actions                      []string    `envconfig:"ACTIONS" required:"true"`
+	AuthKey                      string      `envconfig:"AUTH_KEY"`
+	KeyPath                      string      `envconfig:"KEY_PATH"`
+	Zone                         string      `envconfig:"ZONE"`
+	Region                       string      `envconfig:"REGION"`
+	Cluster                      string      `envconfig:"CLUSTER"`
+	Project                      string      `envconfig:"PROJECT"`
+	Namespace                    string      `envconfig:"NAMESPACE"`
+	ChartRepo                    string      `envconfig:"CHART_REPO"`
+	Bucket                       string      `envconfig:"BUCKET"`
+	ChartPath                    string      `envconfig:"CHART_PATH" required:"true"`
+	ChartVersion                 string      `envconfig:"CHART_VERSION"`
+	Release                      string      `envconfig:"RELEASE"`
+	Package                      string      `envconfig:"PACKAGE"`
+	Values                       []string    `envconfig:"VALUES"`
+	ValueFiles                   []string    `envconfig:"VALUE_FILES"`
+	Secrets                      []string    `envconfig:"SECRETS"`
+	HelmStableRepo               string      `envconfig:"HELM_STABLE_REPO" default:"https://charts.helm.sh/stable"`
+	AllowedActions               []string    `envconfig:"ALLOWED_ACTIONS"`
+	PrintNotes                   bool        `envconfig:"PRINT_NOTES" default:"true"`
+	Devel                        bool        `envconfig:"DEVEL"`
+	NoHooks                      bool        `envconfig:"NO_HOOKS"`
+	GsutilUserProject            string      `envconfig:"GSUTIL_USER_PROJECT"`
+	ResetThenReuseValues         bool        `envconfig:"RESET_THEN_REUSE_VALUES"`
+	BurstLimit                   uint32      `envconfig:"BURST_LIMIT"`
+	QPS                          float32     `envconfig:"QPS"`
+	BotoConfig                   string      `envconfig:"BOTO_CONFIG"`
+	ChartURL                     string      `envconfig:"CHART_URL"`
+	OutputEnvFile                string      `envconfig:"OUTPUT_ENV_FILE"`
+	GenerateName                 bool        `envconfig:"GENERATE_NAME"`
+	TestNamespace                string      `envconfig:"TEST_NAMESPACE"`
+	TestFilter                   []string    `envconfig:"TEST_FILTER"`
+	Buckets                      []string    `envconfig:"BUCKETS"`
+	ChartSHA256                  string      `envconfig:"CHART_SHA256"`
+	ValuesJSON                   jsonValues  `envconfig:"VALUES_JSON"`
+	PublishMetadata              bool        `envconfig:"PUBLISH_METADATA"`
+	Location                     string      `envconfig:"LOCATION"`
+	PrintOnly                    bool        `envconfig:"PRINT_ONLY"`
+	LintQuiet                    bool        `envconfig:"LINT_QUIET"`
+	ChartGlob                    string      `envconfig:"CHART_GLOB"`
+	RepoForceUpdate              bool        `envconfig:"REPO_FORCE_UPDATE" default:"true"`
+	ValueFilesDir                string      `envconfig:"VALUE_FILES_DIR"`
+	FailOnNoChange               bool        `envconfig:"FAIL_ON_NO_CHANGE"`
+	StorageEndpoint              string      `envconfig:"STORAGE_ENDPOINT"`
+	PrintMergedValues            bool        `envconfig:"PRINT_MERGED_VALUES"`
+	UseConnectGateway            bool        `envconfig:"USE_CONNECT_GATEWAY"`
+	MembershipName               string      `envconfig:"MEMBERSHIP_NAME"`
+	GcloudConfigDir              string      `envconfig:"GCLOUD_CONFIG_DIR"`
+	DependencySkipRefresh        bool        `envconfig:"DEPENDENCY_SKIP_REFRESH"`
+	ServerDryRun                 bool        `envconfig:"SERVER_DRY_RUN"`
+	RequestReason                string      `envconfig:"REQUEST_REASON"`
+	HelmDebug                    bool        `envconfig:"HELM_DEBUG"`
+	AutoRollbackOnTestFailure    bool        `envconfig:"AUTO_ROLLBACK_ON_TEST_FAILURE"`
+	NamespaceLabels              []string    `envconfig:"NAMESPACE_LABELS"`
+	WaitInterval                 uint32      `envconfig:"WAIT_INTERVAL"`
+	ShowSubcommand               string      `envconfig:"SHOW_SUBCOMMAND" default:"values"`
+	ChartRef                     string      `envconfig:"CHART_REF"`
+	ServerSideApply              bool        `envconfig:"SERVER_SIDE_APPLY"`
+	MetricsFile                  string      `envconfig:"METRICS_FILE"`
+	HTTPSProxy                   string      `envconfig:"HTTPS_PROXY"`
+	HTTPProxy                    string      `envconfig:"HTTP_PROXY"`
+	NoProxy                      string      `envconfig:"NO_PROXY"`
+	SkipIfExists                 bool        `envconfig:"SKIP_IF_EXISTS"`
+	ErrorIfExists                bool        `envconfig:"ERROR_IF_EXISTS"`
+	ValueOrder                   string      `envconfig:"VALUE_ORDER" default:"files-first"`
+	Replace                      bool        `envconfig:"REPLACE"`
+	HelmUpgradeFlags             []string    `envconfig:"HELM_UPGRADE_FLAGS"`
+	HelmTestFlags                []string    `envconfig:"HELM_TEST_FLAGS"`
+	HelmLintFlags                []string    `envconfig:"HELM_LINT_FLAGS"`
+	DisableOpenAPIValidation     bool        `envconfig:"DISABLE_OPENAPI_VALIDATION"`
+	KmsKey                       string      `envconfig:"KMS_KEY"`
+	Timeout                      string      `envconfig:"TIMEOUT"`
+	CleanupOnFirstInstallFailure bool        `envconfig:"CLEANUP_ON_FIRST_INSTALL_FAILURE"`
+	Releases                     releaseList `envconfig:"RELEASES"`
+	ParallelCompositeThreshold   string      `envconfig:"PARALLEL_COMPOSITE_THRESHOLD"`
+	ParallelProcessCount         uint32      `envconfig:"PARALLEL_PROCESS_COUNT"`
+	HelmVersion                  string      `envconfig:"HELM_VERSION"`
+	SmokeCheck                   bool        `envconfig:"SMOKE_CHECK"`
+	MergeSecrets                 bool        `envconfig:"MERGE_SECRETS"`
+	SecretManagerSecrets         []string    `envconfig:"SECRET_MANAGER_SECRETS"`
+	AuditFile                    string      `envconfig:"AUDIT_FILE"`
+	AuditIncludeSecrets          bool        `envconfig:"AUDIT_INCLUDE_SECRETS"`
+	AuditKmsKey                  string      `envconfig:"AUDIT_KMS_KEY"`
+	DryRun                       string      `envconfig:"DRY_RUN"`
+	ContentType                  string      `envconfig:"CONTENT_TYPE"`
+	Metadata                     []string    `envconfig:"METADATA"`
+	TemplateValues               bool        `envconfig:"TEMPLATE_VALUES"`
+	TemplateMissingKey           string      `envconfig:"TEMPLATE_MISSING_KEY" default:"error"`
+	NoColor                      *bool       `envconfig:"NO_COLOR"`
+	InCluster                    bool        `envconfig:"IN_CLUSTER"`
+	RenderCheck                  bool        `envconfig:"RENDER_CHECK"`
+	TempDir                      string      `envconfig:"TEMP_DIR"`
+	PackageDependencyUpdate      bool        `envconfig:"PACKAGE_DEPENDENCY_UPDATE"`
+	SnapshotFile                 string      `envconfig:"SNAPSHOT_FILE"`
+	DebugActions                 []string    `envconfig:"DEBUG_ACTIONS"`
+	WaitFailureDiagnostics       bool        `envconfig:"WAIT_FAILURE_DIAGNOSTICS"`
+	RepackageGzip                int         `envconfig:"REPACKAGE_GZIP"`
+	BucketAuthKey                string      `envconfig:"BUCKET_AUTH_KEY"`
+	ForceConflicts               bool        `envconfig:"FORCE_CONFLICTS"`
+	ConfigFile                   string      `ignored:"true"`
+	CredentialRetries            int         `envconfig:"CREDENTIAL_RETRIES" default:"3"`
+	ComputedValues               []string    `envconfig:"COMPUTED_VALUES"`
+	GcloudQuiet                  bool        `envconfig:"GCLOUD_QUIET" default:"true"`
+	GitRepo                      string      `envconfig:"GIT_REPO"`
+	GitRef                       string      `envconfig:"GIT_REF"`
+	LogFile                      string      `envconfig:"LOG_FILE"`
+	Lock                         bool        `envconfig:"LOCK"`
+	LockBucket                   string      `envconfig:"LOCK_BUCKET"`
+	LockTimeout                  string      `envconfig:"LOCK_TIMEOUT"`
+	KubeVersion                  string      `envconfig:"KUBE_VERSION"`
+	APIVersions                  []string    `envconfig:"API_VERSIONS"`
+	LintStrict                   bool        `envconfig:"LINT_STRICT"`
+	DNSEndpoint                  bool        `envconfig:"DNS_ENDPOINT"`
+	StateFile                    string      `envconfig:"STATE_FILE"`
+	ForceRerun                   bool        `envconfig:"FORCE_RERUN"`
+	Namespaces                   []string    `envconfig:"NAMESPACES"`
+	Parallelism                  int         `envconfig:"PARALLELISM" default:"4"`
+	ValuesFromK8s                []string    `envconfig:"VALUES_FROM_K8S"`
+	DumpManifestOnFailure        bool        `envconfig:"DUMP_MANIFEST_ON_FAILURE"`
+	HelmDataHome                 string      `envconfig:"HELM_DATA_HOME"`
+	HelmCacheHome                string      `envconfig:"HELM_CACHE_HOME"`
+	HelmConfigHome               string      `envconfig:"HELM_CONFIG_HOME"`
+	ComputeRegion                string      `envconfig:"COMPUTE_REGION"`
+	ComputeZone                  string      `envconfig:"COMPUTE_ZONE"`
+	RegistryLogout               bool        `envconfig:"REGISTRY_LOGOUT" default:"true"`
+
+	// bucketConfigDir is the gcloud config dir of gsutil, in which the
+	// account of the BucketAuthKey is active
+	bucketConfigDir string
+	// cloner clones the GitRepo at a ref into a directory, it is git unless
+	// tests replace it
+	cloner func(repo, ref, dir string) error
+	// locks keeps the lock objects of the releases, it is GCS unless tests
+	// replace it
+	locks lockStore
+	// logWriter writes to the opened LogFile, it is shared by all copies of
+	// the plugin
+	logWriter *lockedWriter
+	// generatedRelease receives the release name generated by the deploy, it
+	// is shared by all copies of the plugin
+	generatedRelease *string
+	// registryLogins records the registries helm logged in to, it is shared
+	// by all copies of the plugin
+	registryLogins *registryHosts
 }
 
 const (
 	gcloudBin  = "gcloud"
 	gsutilBin  = "gsutil"
 	kubectlBin = "kubectl"
-	helmBin    = "helm"
 
 	lintPkg       = "lint"
 	createPkg     = "create"
@@ -55,232 +191,1798 @@ const (
 	deployPkg     = "deploy"
 	testPkg       = "test"
 	dependencyPkg = "dep"
+	showPkg       = "show"
+	snapshotPkg   = "snapshot"
+
+	filesFirst   = "files-first"
+	secretsFirst = "secrets-first"
+
+	updateRetries = 10
+)
+
+// knownActions are all actions execAction can execute
+var knownActions = []string{lintPkg, createPkg, pushPkg, pullPkg, deployPkg, testPkg, dependencyPkg, showPkg, snapshotPkg}
+
+// helmBin is the helm binary, it can be changed by selectHelm
+var helmBin = "helm"
+
+// updateWaitTime is the wait between retries and polls, tests shorten it
+var updateWaitTime = 10 * time.Second
+
+// credentialRetryWait is the wait before the first get-credentials retry,
+// it doubles with every retry
+var credentialRetryWait = 5 * time.Second
 
-	updateWaitTime = 10 * time.Second
-	updateRetries  = 10
+var (
+	// releaseNameRegex matches the release name in the output of helm install
+	releaseNameRegex = regexp.MustCompile(`(?m)^NAME:\s+(?P<name>\S+)`)
+	// kmsKeyRegex matches the resource name of a Cloud KMS key
+	kmsKeyRegex = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	// sizeRegex matches gsutil sizes like 150M
+	sizeRegex = regexp.MustCompile(`^[0-9]+[KMGT]?$`)
+	// kubeVersionRegex matches Kubernetes versions like v1.27 or 1.27.3
+	kubeVersionRegex = regexp.MustCompile(`^v?[0-9]+\.[0-9]+(\.[0-9]+)?$`)
+	// computedValuesRegex matches the computed values in the output of helm upgrade --dry-run --debug
+	computedValuesRegex = regexp.MustCompile(`(?s)COMPUTED VALUES:\n(.*?)\n(?:HOOKS|MANIFEST):`)
+	// contentTypes are the default content types of uploaded files
+	contentTypes = map[string]string{
+		".tgz":  "application/gzip",
+		".yaml": "text/yaml",
+		".md":   "text/markdown",
+	}
 )
 
 // Exec executes the plugin step.
-func (p Plugin) Exec() error {
+func (p Plugin) Exec() (err error) {
+	// every exit is recorded, also the failures before the first action
+	var results []ActionResult
+	defer func() {
+		printResults(os.Stdout, results)
+		if p.MetricsFile != "" {
+			if mErr := writeMetrics(p.MetricsFile, results, err == nil); mErr != nil {
+				log.Printf("could not write metrics file: %v", mErr)
+			}
+		}
+	}()
+
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	// the registry credentials must not stay on shared runners, also if an
+	// action fails
+	if p.RegistryLogout {
+		p.registryLogins = &registryHosts{}
+		defer p.registryLogout()
+	}
+
+	if p.OutputEnvFile != "" {
+		if err := p.writeOutputEnv(); err != nil {
+			return fmt.Errorf("could not write output env file: %w", err)
+		}
+	}
+
 	// only setup project when needed args are provided
-	if p.Project != "" && p.Cluster != "" && (p.Zone != "" || p.Region != "") {
-		if err := setupProject(p.Project, p.Cluster, p.Zone, p.Region, p.Debug); err != nil {
+	if !p.InCluster && p.Project != "" && (p.useConnectGateway() || p.Cluster != "" && (p.Zone != "" || p.Region != "" || p.Location != "")) {
+		if err := p.setupProject(); err != nil {
+			return err
+		}
+	}
+
+	// the later actions use the release name generated by the deploy
+	if p.GenerateName && p.Release == "" && len(p.Releases) == 0 && len(p.Namespaces) == 0 {
+		p.generatedRelease = new(string)
+	}
+
+	// concurrent runs for the same release would corrupt the helm state, a
+	// generated release is locked as soon as its name is known
+	var locked *Plugin
+	lock := func() error {
+		if !p.Lock || locked != nil || p.Release == "" {
+			return nil
+		}
+		lp := p
+		if err := lp.acquireLock(); err != nil {
 			return err
 		}
+		locked = &lp
+		return nil
+	}
+	defer func() {
+		if locked != nil {
+			locked.releaseLock()
+		}
+	}()
+	if err := lock(); err != nil {
+		return err
+	}
+
+	// actions completed by a previous run with the same state file are
+	// skipped, a repeated action only as often as it was completed
+	var state runState
+	if p.StateFile != "" && !p.ForceRerun {
+		if state, err = readState(p.StateFile); err != nil {
+			return fmt.Errorf("could not read state file: %w", err)
+		}
+	}
+	previous := map[string]int{}
+	for _, k := range state.Completed {
+		previous[k]++
 	}
 
+	var deployed bool
 	for _, a := range p.Actions {
-		switch a {
-		case lintPkg:
-			if err := p.lintPackage(); err != nil {
-				return err
+		spec, err := parseAction(a)
+		if err != nil {
+			return err
+		}
+
+		ap := spec.apply(p)
+		key := stateKey(a, ap)
+		if previous[key] > 0 {
+			previous[key]--
+			log.Printf("action '%s' was completed by a previous run, skipping it", a)
+			results = append(results, ActionResult{Action: a, Chart: ap.ChartPath, Success: true, Message: "skipped, completed by a previous run"})
+			if spec.name == deployPkg {
+				deployed = true
 			}
-		case createPkg:
-			if err := p.createPackage(); err != nil {
-				return err
+			continue
+		}
+
+		start := time.Now()
+		err = ap.execAction(spec.name)
+		results = append(results, newActionResult(a, ap.ChartPath, time.Since(start), err))
+		if err != nil && !isWarning(err) {
+			if spec.name == testPkg && deployed && p.AutoRollbackOnTestFailure {
+				if rbErr := ap.rollbackRelease(); rbErr != nil {
+					log.Printf("could not roll back release: %v", rbErr)
+				}
 			}
-		case pushPkg:
-			if err := p.pushPackage(); err != nil {
+			return err
+		}
+		if spec.name == deployPkg {
+			deployed = true
+		}
+		if p.generatedRelease != nil && *p.generatedRelease != "" && p.Release == "" {
+			p.Release = *p.generatedRelease
+			if err := lock(); err != nil {
 				return err
 			}
-		case pullPkg:
-			if err := p.pullPackage(); err != nil {
-				return err
+		}
+		if p.StateFile != "" && !p.PrintOnly {
+			state.Completed = append(state.Completed, key)
+			if err := writeState(p.StateFile, state); err != nil {
+				return fmt.Errorf("could not write state file: %w", err)
 			}
-		case deployPkg:
-			if err := p.deployPackage(); err != nil {
-				return err
+		}
+	}
+
+	// the next run starts anew once all actions are completed
+	if p.StateFile != "" && !p.PrintOnly {
+		if err := os.Remove(p.StateFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove state file: %w", err)
+		}
+	}
+	return nil
+}
+
+// actionSpec is an action with optional per action overrides in the
+// format action[:key=value...], e.g. deploy:namespace=foo
+type actionSpec struct {
+	name      string
+	namespace string
+}
+
+func parseAction(s string) (actionSpec, error) {
+	parts := strings.Split(s, ":")
+	spec := actionSpec{name: parts[0]}
+	for _, o := range parts[1:] {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return spec, fmt.Errorf("invalid option '%s' for action '%s'", o, spec.name)
+		}
+		switch kv[0] {
+		case "namespace":
+			spec.namespace = kv[1]
+		default:
+			return spec, fmt.Errorf("unknown option '%s' for action '%s'", kv[0], spec.name)
+		}
+	}
+	return spec, nil
+}
+
+// apply returns a copy of the plugin with the overrides of the action spec
+// and the debug setting of the action
+func (s actionSpec) apply(p Plugin) Plugin {
+	if s.namespace != "" {
+		p.Namespace = s.namespace
+	}
+	if len(p.DebugActions) > 0 {
+		p.Debug = contains(p.DebugActions, s.name)
+	}
+	return p
+}
+
+// execAction executes a single action.
+func (p Plugin) execAction(action string) error {
+	switch action {
+	case lintPkg:
+		return p.lintPackage()
+	case createPkg:
+		return p.createPackage()
+	case pushPkg:
+		return p.pushPackage()
+	case pullPkg:
+		return p.pullPackage()
+	case deployPkg:
+		return p.deployPackage()
+	case testPkg:
+		return p.testPackage()
+	case dependencyPkg:
+		// repos have to be added before the dependencies can be updated
+		if err := p.addRepo(); err != nil {
+			return err
+		}
+		p.warnMissingRepos()
+		if err := p.registryLogin(p.dependencyRepos()...); err != nil {
+			return err
+		}
+		return p.dependencyUpdate()
+	case showPkg:
+		return p.showPackage()
+	case snapshotPkg:
+		return p.snapshotRelease()
+	default:
+		return errors.New("unknown action")
+	}
+}
+
+// validate checks the plugin parameters before anything is executed.
+func (p Plugin) validate() error {
+	for i, a := range p.Actions {
+		spec, err := parseAction(a)
+		if err != nil {
+			return err
+		}
+		if !contains(knownActions, spec.name) {
+			return fmt.Errorf("unknown action '%s'", spec.name)
+		}
+		if contains(p.Actions[:i], a) {
+			log.Printf("warning: action '%s' is given more than once", a)
+		}
+		if len(p.AllowedActions) > 0 && !contains(p.AllowedActions, spec.name) {
+			return fmt.Errorf("action '%s' is not allowed", spec.name)
+		}
+	}
+	var locations int
+	for _, l := range []string{p.Zone, p.Region, p.Location} {
+		if l != "" {
+			locations++
+		}
+	}
+	if locations > 1 {
+		return errors.New("only one of zone, region and location can be set")
+	}
+	switch p.ShowSubcommand {
+	case "chart", "values", "readme", "all":
+	default:
+		return fmt.Errorf("unknown show subcommand '%s'", p.ShowSubcommand)
+	}
+	for _, m := range p.Metadata {
+		if kv := strings.SplitN(m, "=", 2); len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("metadata '%s' is not a key=value pair", m)
+		}
+	}
+	if p.TemplateMissingKey != missingKeyError && p.TemplateMissingKey != missingKeyWarn {
+		return fmt.Errorf("unknown template missing key mode '%s', must be error or warn", p.TemplateMissingKey)
+	}
+	if p.DNSEndpoint && p.UseConnectGateway {
+		return errors.New("dns endpoint can not be used with the connect gateway")
+	}
+	if p.InCluster && p.UseConnectGateway {
+		return errors.New("in cluster can not be used with the connect gateway")
+	}
+	if p.RepackageGzip < 0 || p.RepackageGzip > gzip.BestCompression {
+		return fmt.Errorf("repackage gzip level %d is not between 1 and %d", p.RepackageGzip, gzip.BestCompression)
+	}
+	if p.ForceConflicts && !p.ServerSideApply {
+		return errors.New("force conflicts requires server side apply")
+	}
+	for _, v := range p.ComputedValues {
+		if _, err := parseComputedValue(v); err != nil {
+			return err
+		}
+	}
+	if p.Lock && p.LockBucket == "" && p.Bucket == "" {
+		return errors.New("lock requires a lock bucket or bucket")
+	}
+	if p.LockTimeout != "" {
+		if _, err := time.ParseDuration(p.LockTimeout); err != nil {
+			return fmt.Errorf("invalid lock timeout '%s': %w", p.LockTimeout, err)
+		}
+	}
+	if p.KubeVersion != "" && !kubeVersionRegex.MatchString(p.KubeVersion) {
+		return fmt.Errorf("kube version '%s' is not of the form v1.27 or 1.27.3", p.KubeVersion)
+	}
+	for _, v := range p.ValuesFromK8s {
+		if _, _, _, _, err := parseK8sValue(v); err != nil {
+			return err
+		}
+	}
+	if len(p.Namespaces) > 1 && p.AuditFile != "" && !strings.Contains(p.AuditFile, namespacePlaceholder) {
+		// the parallel deploys would overwrite each others audit file
+		return fmt.Errorf("audit file '%s' must contain %s when deploying to namespaces", p.AuditFile, namespacePlaceholder)
+	}
+	if p.DumpManifestOnFailure && p.Bucket == "" {
+		return errors.New("dump manifest on failure requires a bucket")
+	}
+	for i, r := range p.Releases {
+		if r.ChartPath == "" {
+			return fmt.Errorf("release %d has no chart_path", i+1)
+		}
+	}
+	if p.ResetThenReuseValues {
+		for _, f := range p.HelmUpgradeFlags {
+			if name := strings.SplitN(f, "=", 2)[0]; name == "--reuse-values" || name == "--reset-values" {
+				return fmt.Errorf("reset then reuse values can not be used with %s", name)
 			}
-		case testPkg:
-			if err := p.testPackage(); err != nil {
-				return err
+		}
+	}
+	switch p.DryRun {
+	case "", "true", "client", "server":
+	default:
+		return fmt.Errorf("unknown dry run mode '%s', must be one of true, client or server", p.DryRun)
+	}
+	if p.ValueOrder != filesFirst && p.ValueOrder != secretsFirst {
+		return fmt.Errorf("unknown value order '%s'", p.ValueOrder)
+	}
+	for _, flags := range [][]string{p.HelmUpgradeFlags, p.HelmTestFlags, p.HelmLintFlags} {
+		if err := validateFlags(flags); err != nil {
+			return err
+		}
+	}
+	if p.Timeout != "" {
+		if _, err := time.ParseDuration(p.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout '%s': %w", p.Timeout, err)
+		}
+	}
+	if p.ParallelCompositeThreshold != "" && !sizeRegex.MatchString(p.ParallelCompositeThreshold) {
+		return fmt.Errorf("invalid parallel composite upload threshold '%s', expected a size like 150M", p.ParallelCompositeThreshold)
+	}
+	if p.KmsKey != "" && !kmsKeyRegex.MatchString(p.KmsKey) {
+		return fmt.Errorf("kms key '%s' is not of the form projects/*/locations/*/keyRings/*/cryptoKeys/*", p.KmsKey)
+	}
+	if p.AuditKmsKey != "" && !kmsKeyRegex.MatchString(p.AuditKmsKey) {
+		return fmt.Errorf("audit kms key '%s' is not of the form projects/*/locations/*/keyRings/*/cryptoKeys/*", p.AuditKmsKey)
+	}
+	if p.UseConnectGateway && p.MembershipName == "" {
+		return errors.New("membership_name is required when using the connect gateway")
+	}
+	if err := p.validateValuesJSON(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// setupProject setups gcloud project.
+func (p Plugin) setupProject() error {
+	// project configuration
+	cmd := p.gcloudCommand("config", "set", "project", p.Project)
+	if err := p.run(cmd); err != nil {
+		return fmt.Errorf("could not the configure the project with glcoud: %w", err)
+	}
+
+	// defaults of gcloud commands without an explicit region or zone
+	for _, c := range []struct{ property, value string }{
+		{"compute/region", p.ComputeRegion},
+		{"compute/zone", p.ComputeZone},
+	} {
+		if c.value == "" {
+			continue
+		}
+		if err := p.run(p.gcloudCommand("config", "set", c.property, c.value)); err != nil {
+			return fmt.Errorf("could not configure %s with gcloud: %w", c.property, err)
+		}
+	}
+
+	// cluster configuration
+	var args []string
+	switch {
+	case p.useConnectGateway():
+		// clusters registered to a fleet are reached through the connect gateway
+		args = []string{"container", "fleet", "memberships", "get-credentials", p.MembershipName}
+		if p.Location != "" {
+			args = append(args, "--location", p.Location)
+		}
+	case p.Location != "":
+		// location is required by autopilot clusters
+		args = []string{"container", "clusters", "get-credentials", p.Cluster, "--location", p.Location}
+	case p.Region != "":
+		args = []string{"container", "clusters", "get-credentials", p.Cluster, "--region", p.Region}
+	default:
+		args = []string{"container", "clusters", "get-credentials", p.Cluster, "--zone", p.Zone}
+	}
+	if p.DNSEndpoint {
+		// the DNS based endpoint does not need authorized networks
+		args = append(args, "--dns-endpoint")
+	}
+
+	// get-credentials fails transiently while the control plane is created
+	// or upgraded, auth errors are not retried
+	wait := credentialRetryWait
+	for attempt := 0; ; attempt++ {
+		err := p.run(p.gcloudCommand(args...))
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrAuthFailed) || attempt >= p.CredentialRetries {
+			return fmt.Errorf("could not configure the cluster with glcoud: %w", err)
+		}
+		log.Printf("could not get cluster credentials, retrying in %s: %v", wait, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+
+	return nil
+}
+
+// useConnectGateway reports whether the cluster credentials are fetched
+// from the fleet membership
+func (p Plugin) useConnectGateway() bool {
+	return p.UseConnectGateway && p.MembershipName != ""
+}
+
+// setupAuth configures gcloud to use the KeyPath as auth file
+func (p Plugin) setupAuth() error {
+	if err := os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", p.KeyPath); err != nil {
+		return fmt.Errorf("could not set GOOGLE_APPLICATION_CREDENTIALS env variable: %v", err)
+	}
+
+	// authorization
+	cmd := p.gcloudCommand("auth", "activate-service-account", fmt.Sprintf("--key-file=%s", p.KeyPath))
+	if err := p.run(cmd); err != nil {
+		return fmt.Errorf("could not authorize with glcoud: %w", err)
+	}
+	return nil
+}
+
+// createPackage creates Helm package for Kubernetes.
+// The package is compressed again with RepackageGzip as gzip level.
+// helm package --version $PLUGIN_CHART_VERSION [--dependency-update] $PLUGIN_CHART_PATH
+func (p Plugin) createPackage() error {
+	args := []string{"package", "--version", p.ChartVersion}
+	if p.PackageDependencyUpdate {
+		args = append(args, "--dependency-update")
+	}
+	args = append(args, p.ChartPath)
+	if err := p.run(exec.Command(helmBin, args...)); err != nil {
+		return err
+	}
+
+	if p.RepackageGzip > 0 && !p.PrintOnly {
+		pkg := fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion)
+		if err := repackage(pkg, p.RepackageGzip); err != nil {
+			return fmt.Errorf("could not repackage %s: %w", pkg, err)
+		}
+	}
+	return nil
+}
+
+// cpPackage copies a file from SOURCE to DEST
+// gsutil [-u $PLUGIN_GSUTIL_USER_PROJECT] [-h HEADER] cp SOURCE DEST
+func (p Plugin) cpPackage(source string, dest string) error {
+	args := p.gsutilArgs()
+	if strings.HasPrefix(dest, "gs://") {
+		args = append(args, p.uploadHeaderArgs(source)...)
+	}
+	if p.ParallelCompositeThreshold != "" {
+		args = append(args, "-o", fmt.Sprintf("GSUtil:parallel_composite_upload_threshold=%s", p.ParallelCompositeThreshold))
+	}
+	if p.ParallelProcessCount > 0 {
+		args = append(args, "-o", fmt.Sprintf("GSUtil:parallel_process_count=%d", p.ParallelProcessCount))
+	}
+	args = append(args, "cp", source, dest)
+	return p.run(p.gsutilCommand(args...))
+}
+
+// uploadHeaderArgs returns the content type and metadata headers of an
+// uploaded file. The content type is derived from the file extension, the
+// configured content type only overrides the one of packages.
+func (p Plugin) uploadHeaderArgs(file string) []string {
+	ext := filepath.Ext(file)
+	contentType := contentTypes[ext]
+	if p.ContentType != "" && ext == ".tgz" {
+		contentType = p.ContentType
+	}
+
+	var args []string
+	if contentType != "" {
+		args = append(args, "-h", "Content-Type:"+contentType)
+	}
+	for _, m := range p.Metadata {
+		kv := strings.SplitN(m, "=", 2)
+		args = append(args, "-h", fmt.Sprintf("x-goog-meta-%s:%s", kv[0], kv[1]))
+	}
+	return args
+}
+
+// gcloudCommand returns the gcloud command. With GcloudQuiet gcloud does not
+// prompt, but uses the defaults.
+func (p Plugin) gcloudCommand(args ...string) *exec.Cmd {
+	if p.GcloudQuiet {
+		args = append([]string{"--quiet"}, args...)
+	}
+	return exec.Command(gcloudBin, args...)
+}
+
+// gsutilCommand returns the gsutil command, which runs with the account of
+// the BucketAuthKey if one is configured
+func (p Plugin) gsutilCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(gsutilBin, args...)
+	if p.bucketConfigDir != "" {
+		cmd.Env = append(os.Environ(), "CLOUDSDK_CONFIG="+p.bucketConfigDir)
+	}
+	return cmd
+}
+
+// gsutilArgs returns the global gsutil options
+func (p Plugin) gsutilArgs() []string {
+	var args []string
+	if p.GsutilUserProject != "" {
+		args = append(args, "-u", p.GsutilUserProject)
+	}
+	if p.KmsKey != "" {
+		args = append(args, "-o", fmt.Sprintf("GSUtil:encryption_key=%s", p.KmsKey))
+	}
+	if p.StorageEndpoint != "" {
+		args = append(args,
+			"-o", fmt.Sprintf("Credentials:gs_host=%s", p.StorageEndpoint),
+			"-o", fmt.Sprintf("Credentials:gs_json_host=%s", p.StorageEndpoint),
+		)
+	}
+	return args
+}
+
+// cpPackage pulls helm chart from Google Storage to local
+// gsutil cp $PACKAGE-$PLUGIN_CHART_VERSION.tgz gs://$PLUGIN_BUCKET
+func (p Plugin) pullPackage() error {
+	pkg := fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion)
+	if err := p.cpPackage(fmt.Sprintf("gs://%s/%s", p.Bucket, pkg), pkg); err != nil {
+		return err
+	}
+
+	// with print only nothing was downloaded
+	if p.ChartSHA256 != "" && !p.PrintOnly {
+		if err := verifySHA256(pkg, p.ChartSHA256); err != nil {
+			return fmt.Errorf("could not verify package %s: %w", pkg, err)
+		}
+	}
+	return nil
+}
+
+// verifySHA256 checks that the sha256 checksum of the file matches the
+// expected hex encoded checksum.
+func verifySHA256(file, expected string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, expected) {
+		return fmt.Errorf("sha256 checksum mismatch: expected %s, got %s", expected, sum)
+	}
+	return nil
+}
+
+// pushPackage pushes Helm package to the Google Storage.
+// gsutil cp $PACKAGE-$PLUGIN_CHART_VERSION.tgz gs://$PLUGIN_BUCKET
+func (p Plugin) pushPackage() error {
+	pkg := fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion)
+	for _, b := range p.pushBuckets() {
+		if p.SkipIfExists || p.ErrorIfExists {
+			exists, err := p.objectExists(fmt.Sprintf("gs://%s/%s", b, pkg))
+			if err != nil {
+				return fmt.Errorf("could not check if package exists in bucket '%s': %w", b, err)
 			}
-		case dependencyPkg:
-			if err := p.addRepo(); err != nil {
-				return err
+			if exists && p.ErrorIfExists {
+				return fmt.Errorf("package %s already exists in bucket '%s'", pkg, b)
 			}
-			if err := p.dependencyUpdate(); err != nil {
-				return err
+			if exists {
+				log.Printf("package %s already exists in bucket '%s', skipping push", pkg, b)
+				continue
 			}
-		default:
-			return errors.New("unknown action")
 		}
+
+		if err := p.cpPackage(pkg, fmt.Sprintf("gs://%s", b)); err != nil {
+			return fmt.Errorf("could not push package to bucket '%s': %w", b, err)
+		}
+		if p.PublishMetadata {
+			if err := p.pushMetadata(b); err != nil {
+				return fmt.Errorf("could not push metadata to bucket '%s': %w", b, err)
+			}
+		}
+	}
+	return nil
+}
+
+// objectExists reports whether the Google Storage object exists
+// gsutil stat gs://$BUCKET/$OBJECT
+func (p Plugin) objectExists(url string) (bool, error) {
+	args := append(p.gsutilArgs(), "stat", url)
+	_, err := p.output(p.gsutilCommand(args...))
+	if err == nil {
+		// nothing was checked with print only
+		return !p.PrintOnly, nil
+	}
+	if strings.Contains(exitErrorOutput(err), "No URLs matched") {
+		return false, nil
+	}
+	return false, err
+}
+
+// pushMetadata pushes the values.yaml and README.md of the chart to the bucket.
+// Missing files are skipped.
+// gsutil cp $PLUGIN_CHART_PATH/values.yaml gs://$BUCKET/$PACKAGE/
+func (p Plugin) pushMetadata(bucket string) error {
+	for _, name := range []string{"values.yaml", "README.md"} {
+		f := filepath.Join(p.ChartPath, name)
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			log.Printf("chart has no %s, skipping upload", name)
+			continue
+		}
+		if err := p.cpPackage(f, fmt.Sprintf("gs://%s/%s/", bucket, p.Package)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushBuckets returns all buckets the package is pushed to
+func (p Plugin) pushBuckets() []string {
+	var buckets []string
+	if p.Bucket != "" {
+		buckets = append(buckets, p.Bucket)
+	}
+	for _, b := range p.Buckets {
+		if !contains(buckets, b) {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// showPackage prints information about the chart ref or the local chart.
+// helm show $PLUGIN_SHOW_SUBCOMMAND $PLUGIN_CHART_REF --version $PLUGIN_CHART_VERSION [--devel]
+func (p Plugin) showPackage() error {
+	chart := p.ChartRef
+	if chart == "" {
+		chart = p.ChartPath
+	}
+	if err := p.registryLogin(chart); err != nil {
+		return err
+	}
+	args := []string{"show", p.ShowSubcommand, chart}
+	if p.ChartVersion != "" {
+		args = append(args, "--version", p.ChartVersion)
+	}
+	if p.Devel {
+		// pre-release versions of the chart ref are only found with --devel
+		args = append(args, "--devel")
+	}
+
+	cmd := exec.Command(helmBin, args...)
+	cmd.Stdout = os.Stdout
+	return p.run(cmd)
+}
+
+// snapshotRelease writes everything helm knows about the release to the
+// snapshot file, to be able to reconstruct it. A gs:// snapshot file is
+// uploaded to the bucket. A missing release is skipped.
+// helm get all $RELEASE --namespace $NAMESPACE
+func (p Plugin) snapshotRelease() error {
+	out, err := p.output(exec.Command(helmBin, "get", "all", p.Release, "--namespace", p.Namespace))
+	if errors.Is(err, ErrReleaseNotFound) {
+		log.Printf("release %s does not exist, skipping snapshot", p.Release)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get release %s: %w", p.Release, err)
+	}
+	if p.PrintOnly {
+		return nil
+	}
+
+	file := p.SnapshotFile
+	if file == "" {
+		file = fmt.Sprintf("%s-snapshot.yaml", p.Release)
+	}
+	if !strings.HasPrefix(file, "gs://") {
+		return ioutil.WriteFile(file, out, 0600)
+	}
+
+	tmp, err := ioutil.TempFile(p.tempDir(""), "snapshot-*.yaml")
+	if err != nil {
+		return fmt.Errorf("could not create temp file for the snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write snapshot to temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close the snapshot temp file: %w", err)
+	}
+	return p.cpPackage(tmp.Name(), file)
+}
+
+// lintFindings returns the warning and error lines of the helm lint output
+func lintFindings(out string) (warnings, errs []string) {
+	for _, l := range strings.Split(out, "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "[WARNING]"):
+			warnings = append(warnings, l)
+		case strings.HasPrefix(l, "[ERROR]"):
+			errs = append(errs, l)
+		}
+	}
+	return warnings, errs
+}
+
+// helm lint $CHARTPATH -i
+// helm template $RELEASE $CHARTPATH
+func (p Plugin) lintPackage() error {
+	if p.TemplateValues {
+		templated, tempFiles, err := p.withTemplatedValues()
+		defer removeFiles(tempFiles)
+		if err != nil {
+			return err
+		}
+		p = templated
+	}
+
+	args := []string{
+		helmBin,
+		"lint",
+		p.ChartPath,
+	}
+
+	args = append(args, p.createValueFileArgs()...)
+	args = append(args, p.capabilityArgs()...)
+	if p.LintQuiet {
+		args = append(args, "--quiet")
+	}
+	args = append(args, shellQuoteAll(p.HelmLintFlags)...)
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", strings.Join(args, " "))
+	cmd.Stdout = &out
+	if p.Debug {
+		cmd.Stdout = io.MultiWriter(&out, os.Stdout)
+	}
+	err := p.run(cmd)
+	warnings, lintErrors := lintFindings(out.String())
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(lintErrors) > 0 {
+			return fmt.Errorf("lint of chart %s failed with exit code %d: %s", p.ChartPath, exitErr.ExitCode(), strings.Join(lintErrors, "; "))
+		}
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("lint of chart %s failed with exit code %d", p.ChartPath, exitErr.ExitCode())
+		}
+		return fmt.Errorf("could not lint chart %s: %w", p.ChartPath, err)
+	}
+	// warnings do not fail helm lint, they are only advisory unless lint is strict
+	if len(warnings) > 0 {
+		log.Printf("warning: lint of chart %s found %d warnings:\n%s", p.ChartPath, len(warnings), strings.Join(warnings, "\n"))
+		if p.LintStrict {
+			return fmt.Errorf("lint of chart %s found %d warnings", p.ChartPath, len(warnings))
+		}
+	}
+
+	// lint does not catch all errors that only happen when the templates are executed
+	if p.RenderCheck {
+		if _, err := p.renderManifests(p.ChartPath, p.createValueFileArgs()); err != nil {
+			return fmt.Errorf("chart %s fails to render: %w: %s", p.ChartPath, err, strings.TrimSpace(exitErrorOutput(err)))
+		}
+	}
+	if len(warnings) > 0 {
+		// the summary reports the warnings apart from a clean lint
+		return &actionWarning{msg: fmt.Sprintf("lint of chart %s found %d warnings", p.ChartPath, len(warnings))}
+	}
+	return nil
+}
+
+func (p Plugin) dependencyUpdate() error {
+	args := []string{"dependency", "update", p.ChartPath}
+	if p.DependencySkipRefresh {
+		args = append(args, "--skip-refresh")
+	}
+	return p.run(exec.Command(helmBin, args...))
+}
+
+func (p Plugin) createValueFileArgs() []string {
+	var args []string
+	for _, f := range p.valueFilesFromDir() {
+		args = append(args, "-f", f)
+	}
+	if len(p.ValueFiles) > 0 {
+		for _, f := range p.ValueFiles {
+			args = append(args, "-f", f)
+		}
+	}
+	if len(p.Values) > 0 {
+		// Drone passes lists comma separated, so the values are joined again.
+		// The argument is quoted so helm escapes like \, survive the shell.
+		args = append(args, "--set", shellQuote(strings.Join(p.Values, ",")))
+	}
+	for _, v := range p.ValuesJSON {
+		args = append(args, "--set-json", shellQuote(v))
+	}
+	return args
+}
+
+// jsonValues is a list of key=json pairs. Drone passes lists as a comma
+// separated string, so the list is only split on commas outside of JSON
+// objects, arrays and strings.
+type jsonValues []string
+
+// Decode implements envconfig.Decoder
+func (v *jsonValues) Decode(value string) error {
+	var (
+		depth    int
+		inString bool
+		escaped  bool
+		start    int
+	)
+	for i, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && inString:
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			*v = append(*v, value[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(value) {
+		*v = append(*v, value[start:])
+	}
+	return nil
+}
+
+// valueFilesFromDir returns all yaml files in the ValueFilesDir sorted by name
+func (p Plugin) valueFilesFromDir() []string {
+	if p.ValueFilesDir == "" {
+		return nil
+	}
+	var files []string
+	for _, ext := range []string{"*.yaml", "*.yml"} {
+		// the pattern is static, so Glob can not fail
+		matches, _ := filepath.Glob(filepath.Join(p.ValueFilesDir, ext))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// validateFlags checks that the extra flags are flags. They are quoted with
+// shellQuoteAll for the shell they are run with.
+func validateFlags(flags []string) error {
+	for _, f := range flags {
+		if !strings.HasPrefix(f, "-") {
+			return fmt.Errorf("extra flag '%s' does not start with '-'", f)
+		}
+	}
+	return nil
+}
+
+// validateValuesJSON checks that all ValuesJSON entries are key=value pairs
+// with a valid JSON value.
+func (p Plugin) validateValuesJSON() error {
+	for _, v := range p.ValuesJSON {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("json value '%s' is not a key=value pair", v)
+		}
+		if !json.Valid([]byte(kv[1])) {
+			return fmt.Errorf("json value for key '%s' is not valid JSON", kv[0])
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s for the use in a /bin/sh command line
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// shellQuoteAll quotes every argument for the use in a /bin/sh command line
+func shellQuoteAll(args []string) []string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return quoted
+}
+
+func (p Plugin) addRepo() error {
+	args := []string{"repo", "add", "stable", p.HelmStableRepo}
+	if p.RepoForceUpdate {
+		args = append(args, "--force-update")
+	}
+	if err := p.run(exec.Command(helmBin, args...)); err != nil {
+		return fmt.Errorf("could not add stable repo '%s': %w", p.HelmStableRepo, err)
+	}
+	if err := p.run(exec.Command(helmBin, "repo", "update")); err != nil {
+		return fmt.Errorf("could not update repos: %w", err)
+	}
+	return nil
+}
+
+// helm upgrade $PACKAGE $PACKAGE-$PLUGIN_CHART_VERSION.tgz -i
+func (p Plugin) deployPackage() error {
+	if len(p.Releases) > 0 {
+		return p.deployReleases()
+	}
+	if len(p.Namespaces) > 0 {
+		return p.deployNamespaces()
+	}
+
+	// We need to create the namespace because Helm 3 does not create the namespace for us anymore.
+	// A dry run must not change the cluster.
+	if p.DryRun == "" {
+		if _, err := p.createNamespace(p.Namespace); err != nil {
+			return fmt.Errorf("could not create namespace: %w", err)
+		}
+	}
+
+	var tempFiles []string
+	defer func() { removeFiles(tempFiles) }()
+
+	if p.TemplateValues {
+		templated, rendered, err := p.withTemplatedValues()
+		tempFiles = append(tempFiles, rendered...)
+		if err != nil {
+			return err
+		}
+		p = templated
+	}
+
+	chart := fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion)
+	if p.ChartGlob != "" {
+		matches, err := filepath.Glob(p.ChartGlob)
+		if err != nil {
+			return fmt.Errorf("invalid chart glob '%s': %w", p.ChartGlob, err)
+		}
+		switch {
+		case p.PrintOnly:
+			// the package of a create action was not built, the commands
+			// show the pattern instead
+			chart = p.ChartGlob
+		case len(matches) != 1:
+			return fmt.Errorf("chart glob '%s' must match exactly one file, found %d", p.ChartGlob, len(matches))
+		default:
+			chart = matches[0]
+		}
+	}
+	if p.ChartURL != "" && p.PrintOnly {
+		// nothing is downloaded, the commands show the url instead
+		log.Printf("would download: %s", sanitize(p.ChartURL))
+		chart = p.ChartURL
+	} else if p.ChartURL != "" {
+		f, err := p.downloadChart()
+		if f != "" {
+			tempFiles = append(tempFiles, f)
+		}
+		if err != nil {
+			return fmt.Errorf("could not download chart: %w", err)
+		}
+		chart = f
+	}
+	if p.GitRepo != "" {
+		dir, repoChart, err := p.cloneChartRepo()
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+		chart = repoChart
+	}
+
+	generateName := p.GenerateName && p.Release == ""
+	args := []string{
+		helmBin,
+		"upgrade",
+		p.Release,
+		chart,
+	}
+	if generateName {
+		args = []string{helmBin, "install", chart, "--generate-name"}
+	}
+
+	var cleartexts [][]byte
+	for _, f := range p.Secrets {
+		cleartext, err := sops_decrypt.File(f, secretFormat(f))
+		if err != nil {
+			return fmt.Errorf("could not decrypt secret file: %w", err)
+		}
+		cleartexts = append(cleartexts, cleartext)
+	}
+	if p.MergeSecrets && len(cleartexts) > 1 {
+		merged, err := mergeYAML(cleartexts)
+		if err != nil {
+			return fmt.Errorf("could not merge decrypted secrets: %w", err)
+		}
+		cleartexts = [][]byte{merged}
+	}
+
+	var secretArgs []string
+	for _, cleartext := range cleartexts {
+		tmp, err := ioutil.TempFile(p.tempDir("."), "decrypted")
+		if err != nil {
+			return fmt.Errorf("could not create temp file for the decrypted secrets: %w", err)
+		}
+		defer tmp.Close()
+		tempFiles = append(tempFiles, tmp.Name())
+
+		if _, err := tmp.Write(cleartext); err != nil {
+			return fmt.Errorf("could not write temp file with decrypted secrets: %w", err)
+		}
+		if err := tmp.Sync(); err != nil {
+			return fmt.Errorf("could not sync temp file with decrypted secrets: %w", err)
+		}
+		secretArgs = append(secretArgs, "-f", tmp.Name())
+	}
+	for _, s := range p.SecretManagerSecrets {
+		arg, err := p.fetchSecretManagerValue(s)
+		if err != nil {
+			return err
+		}
+		secretArgs = append(secretArgs, "--set-string", arg)
+	}
+	for _, s := range p.ValuesFromK8s {
+		arg, err := p.lookupK8sValue(s)
+		if err != nil {
+			return err
+		}
+		secretArgs = append(secretArgs, "--set-string", arg)
+	}
+
+	// later value files override earlier ones
+	valueArgs := append(p.createValueFileArgs(), secretArgs...)
+	if p.ValueOrder == secretsFirst {
+		valueArgs = append(secretArgs, p.createValueFileArgs()...)
+	}
+	computedArgs, err := p.computedValueArgs()
+	if err != nil {
+		return err
+	}
+	valueArgs = append(valueArgs, computedArgs...)
+	args = append(args, valueArgs...)
+
+	if p.PrintMergedValues && !generateName {
+		// the printed values must not contain the secrets
+		if err := p.printMergedValues(chart, append(p.createValueFileArgs(), computedArgs...)); err != nil {
+			return err
+		}
+	}
+
+	if p.ServerDryRun {
+		if err := p.validateManifests(chart, valueArgs); err != nil {
+			return err
+		}
+	}
+
+	if p.FailOnNoChange && !generateName {
+		if err := p.checkChanges(chart, valueArgs); err != nil {
+			return err
+		}
+	}
+
+	if p.Recreate {
+		args = append(args, "--recreate-pods")
+	}
+	if p.NoHooks {
+		args = append(args, "--no-hooks")
+	}
+	if p.ResetThenReuseValues {
+		if err := p.requireHelmVersion("--reset-then-reuse-values", 3, 14); err != nil {
+			return err
+		}
+		args = append(args, "--reset-then-reuse-values")
+	}
+	if p.ServerSideApply {
+		if err := p.requireHelmVersion("--server-side", 4, 0); err != nil {
+			return err
+		}
+		args = append(args, "--server-side")
+		if p.ForceConflicts {
+			log.Printf("warning: force conflicts is set, fields managed by other field managers are overwritten")
+			args = append(args, "--force-conflicts")
+		}
+	}
+	if p.DisableOpenAPIValidation {
+		log.Printf("warning: OpenAPI validation is disabled, invalid manifests will not be rejected before applying them")
+		args = append(args, "--disable-openapi-validation")
+	}
+	if p.BurstLimit > 0 {
+		args = append(args, "--burst-limit", fmt.Sprintf("%d", p.BurstLimit))
+	}
+	if p.QPS > 0 {
+		args = append(args, "--qps", strconv.FormatFloat(float64(p.QPS), 'f', -1, 32))
+	}
+	if !generateName {
+		args = append(args, "--install")
+	}
+	if p.DryRun != "" {
+		arg, err := p.dryRunArg()
+		if err != nil {
+			return err
+		}
+		args = append(args, arg)
+	}
+	if p.Replace {
+		if generateName {
+			args = append(args, "--replace")
+		} else {
+			log.Printf("warning: --replace is only supported by helm install and is not passed to helm upgrade --install")
+		}
+	}
+	args = append(args, "--namespace", p.Namespace)
+
+	args = append(args, shellQuoteAll(p.HelmUpgradeFlags)...)
+
+	// with a wait interval the plugin waits for the rollout itself
+	customWait := p.Wait && p.WaitInterval > 0
+	if p.Wait && !customWait {
+		args = append(args, "--wait", "--timeout", p.timeoutArg())
+	}
+
+	var firstInstall bool
+	if p.CleanupOnFirstInstallFailure && !generateName && p.DryRun == "" {
+		_, err := p.releaseRevision()
+		firstInstall = errors.Is(err, ErrReleaseNotFound)
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", strings.Join(args, " "))
+	if generateName {
+		cmd.Stdout = &out
+		if p.Debug {
+			cmd.Stdout = io.MultiWriter(&out, os.Stdout)
+		}
+	}
+	if err := p.run(cmd); err != nil {
+		if p.Wait && !generateName {
+			p.dumpFailedPodLogs()
+			if p.WaitFailureDiagnostics && errors.Is(err, ErrTimeout) {
+				p.dumpWaitDiagnostics()
+			}
+		}
+		if p.DumpManifestOnFailure {
+			p.dumpFailedManifests(chart, valueArgs)
+		}
+		if firstInstall {
+			p.uninstallFailedRelease()
+		}
+		return err
+	}
+
+	// nothing was deployed, so there is nothing to wait for or check
+	if p.DryRun != "" {
+		return nil
+	}
+
+	if generateName && !p.PrintOnly {
+		name, err := scanNamed(out.String(), releaseNameRegex)
+		if err != nil {
+			return fmt.Errorf("could not find generated release name: %w", err)
+		}
+		p.Release = name["name"]
+		log.Printf("generated release name: %s", p.Release)
+		if p.generatedRelease != nil {
+			*p.generatedRelease = p.Release
+		}
+		if p.OutputEnvFile != "" {
+			if err := p.writeOutputEnv(); err != nil {
+				return fmt.Errorf("could not write output env file: %w", err)
+			}
+		}
+	}
+
+	if customWait {
+		if err := p.waitForRollout(); err != nil {
+			p.dumpFailedPodLogs()
+			if p.WaitFailureDiagnostics && errors.Is(err, ErrTimeout) {
+				p.dumpWaitDiagnostics()
+			}
+			if p.DumpManifestOnFailure {
+				p.dumpFailedManifests(chart, valueArgs)
+			}
+			if firstInstall {
+				p.uninstallFailedRelease()
+			}
+			return err
+		}
+	}
+
+	if p.SmokeCheck {
+		if err := p.smokeCheck(); err != nil {
+			return err
+		}
+	}
+
+	if p.AuditFile != "" {
+		if err := p.writeAudit(chart, valueArgs); err != nil {
+			return fmt.Errorf("could not write audit file: %w", err)
+		}
+	}
+
+	if p.PrintNotes {
+		// the release is deployed already, missing notes do not fail the deploy
+		if err := p.printNotes(); err != nil {
+			log.Printf("could not get release notes: %v", err)
+		}
+	}
+	return nil
+}
+
+// dryRunArg returns the helm dry run flag of the dry run mode. The client and
+// server modes require helm 3.13.
+func (p Plugin) dryRunArg() (string, error) {
+	if p.DryRun == "true" {
+		return "--dry-run", nil
+	}
+	arg := "--dry-run=" + p.DryRun
+	if err := p.requireHelmVersion(arg, 3, 13); err != nil {
+		return "", err
+	}
+	return arg, nil
+}
+
+// tempDir returns the directory for temporary files, the fallback is used
+// if no TempDir is configured
+func (p Plugin) tempDir(fallback string) string {
+	if p.TempDir != "" {
+		return p.TempDir
+	}
+	return fallback
+}
+
+// removeFiles removes the temporary files, errors are only printed
+func removeFiles(files []string) {
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			fmt.Printf("could not remove temp file: %v", err)
+		}
+	}
+}
+
+// printMergedValues prints the values the release would be deployed with.
+// The values args must not contain secrets, masked values are redacted.
+// helm upgrade $RELEASE $CHART --install --dry-run --debug --namespace $NAMESPACE
+func (p Plugin) printMergedValues(chart string, valueArgs []string) error {
+	args := []string{helmBin, "upgrade", p.Release, chart}
+	args = append(args, valueArgs...)
+	args = append(args, "--install", "--dry-run", "--debug", "--namespace", p.Namespace)
+
+	out, err := p.output(exec.Command("/bin/sh", "-c", strings.Join(args, " ")))
+	if err != nil {
+		return fmt.Errorf("could not compute merged values: %w", err)
+	}
+	values := string(out)
+	if m := computedValuesRegex.FindStringSubmatch(values); m != nil {
+		values = m[1]
+	}
+	fmt.Printf("merged values:\n%s\n", sanitize(values))
+	return nil
+}
+
+// validateManifests renders the chart and validates the manifests against
+// the cluster without applying them.
+// helm template $RELEASE $CHART | kubectl apply --dry-run=server -f -
+func (p Plugin) validateManifests(chart string, valueArgs []string) error {
+	manifests, err := p.renderManifests(chart, valueArgs)
+	if err != nil {
+		return err
 	}
 
+	var stderr bytes.Buffer
+	args := []string{"apply", "--dry-run=server", "--validate=true", "--namespace", p.Namespace, "-f", "-"}
+	if p.ServerSideApply {
+		args = append(args, "--server-side")
+		if p.ForceConflicts {
+			args = append(args, "--force-conflicts")
+		}
+	}
+	cmd := exec.Command(kubectlBin, args...)
+	cmd.Stdin = bytes.NewReader(manifests)
+	cmd.Stderr = &stderr
+	if err := p.run(cmd); err != nil {
+		return fmt.Errorf("manifests failed server side validation: %v: %s", err, strings.TrimSpace(stripANSI(stderr.String())))
+	}
 	return nil
 }
 
-// setupProject setups gcloud project.
-func setupProject(project, cluster, zone, region string, debug bool) error {
-	// project configuration
-	cmd := exec.Command(gcloudBin, "config", "set", "project", project)
-	if err := run(cmd, debug); err != nil {
-		return fmt.Errorf("could not the configure the project with glcoud: %v", err)
+// renderManifests renders the chart with the values locally.
+// helm template $RELEASE $CHART --namespace $NAMESPACE
+func (p Plugin) renderManifests(chart string, valueArgs []string) ([]byte, error) {
+	args := []string{helmBin, "template", p.Release, chart}
+	args = append(args, valueArgs...)
+	args = append(args, p.capabilityArgs()...)
+	// helm lint has no --api-versions
+	for _, v := range p.APIVersions {
+		args = append(args, "--api-versions", shellQuote(v))
+	}
+	args = append(args, "--namespace", p.Namespace)
+
+	out, err := p.output(exec.Command("/bin/sh", "-c", strings.Join(args, " ")))
+	if err != nil {
+		return nil, fmt.Errorf("could not render chart: %w", err)
 	}
+	return out, nil
+}
 
-	// cluster configuration
-	cmd = exec.Command(gcloudBin, "container", "clusters", "get-credentials", cluster, "--zone", zone)
-	if region != "" {
-		// override zone when region is set
-		cmd = exec.Command(gcloudBin, "container", "clusters", "get-credentials", cluster, "--region", region)
+// capabilityArgs returns the flags of the capabilities the chart is
+// rendered for without a cluster
+func (p Plugin) capabilityArgs() []string {
+	var args []string
+	if p.KubeVersion != "" {
+		args = append(args, "--kube-version", p.KubeVersion)
 	}
+	return args
+}
 
-	if err := run(cmd, debug); err != nil {
-		return fmt.Errorf("could not configure the cluster with glcoud: %v", err)
+// checkChanges fails if upgrading the release with the chart and values
+// would not change any resources. Requires the helm-diff plugin.
+// The diff reuses the values like the deploy does, so reused values do not
+// show up as changes.
+// helm diff upgrade $RELEASE $CHART --allow-unreleased --namespace $NAMESPACE
+func (p Plugin) checkChanges(chart string, valueArgs []string) error {
+	args := []string{helmBin, "diff", "upgrade", p.Release, chart}
+	args = append(args, valueArgs...)
+	args = append(args, shellQuoteAll(p.valueReuseArgs())...)
+	if p.noColor() {
+		args = append(args, "--no-color")
 	}
+	args = append(args, "--allow-unreleased", "--namespace", p.Namespace)
 
+	out, err := p.output(exec.Command("/bin/sh", "-c", strings.Join(args, " ")))
+	if err != nil {
+		return fmt.Errorf("could not diff release: %w", err)
+	}
+	if p.Debug {
+		fmt.Print(string(out))
+	}
+	if !p.PrintOnly && isEmptyDiff(string(out)) {
+		return errors.New("deploy would not change any resources")
+	}
 	return nil
 }
 
-// setupAuth configures gcloud to use the given authFile
-func setupAuth(authFile string, debug bool) error {
-	if err := os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", authFile); err != nil {
-		return fmt.Errorf("could not set GOOGLE_APPLICATION_CREDENTIALS env variable: %v", err)
+// noColor reports whether colored output is disabled. Defaults to true if
+// the standard output is not a terminal.
+func (p Plugin) noColor() bool {
+	if p.NoColor != nil {
+		return *p.NoColor
 	}
+	fi, err := os.Stdout.Stat()
+	return err != nil || fi.Mode()&os.ModeCharDevice == 0
+}
 
-	// authorization
-	cmd := exec.Command(gcloudBin, "auth", "activate-service-account", fmt.Sprintf("--key-file=%s", authFile))
-	if err := run(cmd, debug); err != nil {
-		return fmt.Errorf("could not authorize with glcoud: %v", err)
+// valueReuseArgs returns the flags of the deploy that control how the values
+// of the current release are reused
+func (p Plugin) valueReuseArgs() []string {
+	var args []string
+	if p.ResetThenReuseValues {
+		args = append(args, "--reset-then-reuse-values")
 	}
-	return nil
+	for _, f := range p.HelmUpgradeFlags {
+		name := strings.SplitN(f, "=", 2)[0]
+		if contains([]string{"--reuse-values", "--reset-values", "--reset-then-reuse-values"}, name) && !contains(args, f) {
+			args = append(args, f)
+		}
+	}
+	return args
 }
 
-// createPackage creates Helm package for Kubernetes.
-// helm package --version $PLUGIN_CHART_VERSION $PLUGIN_CHART_PATH
-func (p Plugin) createPackage() error {
-	return run(exec.Command(helmBin, "package", "--version", p.ChartVersion, p.ChartPath), p.Debug)
+// isEmptyDiff reports whether the helm diff output contains no changes
+func isEmptyDiff(out string) bool {
+	return strings.TrimSpace(stripANSI(out)) == ""
 }
 
-// cpPackage copies a file from SOURCE to DEST
-// gsutil cp SOURCE DEST
-func (p Plugin) cpPackage(source string, dest string) error {
-	return run(exec.Command(gsutilBin, "cp", source, dest), p.Debug)
+// uninstallFailedRelease removes a release whose first install failed, so
+// no partial release is left behind.
+// The delete hooks are skipped like the install hooks with NoHooks.
+// helm uninstall $RELEASE --namespace $NAMESPACE [--no-hooks]
+func (p Plugin) uninstallFailedRelease() {
+	log.Printf("first install of release %s failed, uninstalling it", p.Release)
+	args := []string{"uninstall", p.Release, "--namespace", p.Namespace}
+	if p.NoHooks {
+		args = append(args, "--no-hooks")
+	}
+	if err := p.run(exec.Command(helmBin, args...)); err != nil {
+		log.Printf("could not uninstall release %s: %v", p.Release, err)
+	}
 }
 
-// cpPackage pulls helm chart from Google Storage to local
-// gsutil cp $PACKAGE-$PLUGIN_CHART_VERSION.tgz gs://$PLUGIN_BUCKET
-func (p Plugin) pullPackage() error {
-	return p.cpPackage(
-		fmt.Sprintf("gs://%s/%s-%s.tgz", p.Bucket, p.Package, p.ChartVersion),
-		fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion),
-	)
+// waitForRollout polls the rollout status of all deployments, statefulsets
+// and daemonsets of the release every WaitInterval seconds until all are
+// rolled out or the timeout is reached.
+// kubectl rollout status $RESOURCE --namespace $NAMESPACE --watch=false
+func (p Plugin) waitForRollout() error {
+	interval := time.Duration(p.WaitInterval) * time.Second
+	deadline := time.Now().Add(p.timeout())
+	for {
+		out, err := p.output(exec.Command(kubectlBin, "get", "deployments,statefulsets,daemonsets",
+			"--namespace", p.Namespace,
+			"--selector", fmt.Sprintf("app.kubernetes.io/instance=%s", p.Release),
+			"--output", "name",
+		))
+		if err != nil {
+			return fmt.Errorf("could not list resources of the release: %w", err)
+		}
+
+		var pending []string
+		for _, r := range strings.Fields(string(out)) {
+			status, err := p.output(exec.Command(kubectlBin, "rollout", "status", r, "--namespace", p.Namespace, "--watch=false"))
+			if err != nil || !strings.Contains(string(status), "successfully rolled out") {
+				pending = append(pending, r)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("%w: waiting for the rollout of %s", ErrTimeout, strings.Join(pending, ", "))
+		}
+		time.Sleep(interval)
+	}
 }
 
-// pushPackage pushes Helm package to the Google Storage.
-// gsutil cp $PACKAGE-$PLUGIN_CHART_VERSION.tgz gs://$PLUGIN_BUCKET
-func (p Plugin) pushPackage() error {
-	return p.cpPackage(
-		fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion),
-		fmt.Sprintf("gs://%s", p.Bucket),
-	)
+// smokeCheck waits until all pods of the release are running or completed
+// and fails if they are not within the timeout.
+// kubectl get pods --namespace $NAMESPACE --selector app.kubernetes.io/instance=$RELEASE
+func (p Plugin) smokeCheck() error {
+	deadline := time.Now().Add(p.timeout())
+	for {
+		out, err := p.output(exec.Command(kubectlBin, "get", "pods",
+			"--namespace", p.Namespace,
+			"--selector", fmt.Sprintf("app.kubernetes.io/instance=%s", p.Release),
+			"--output", `jsonpath={range .items[*]}{.metadata.name}={.status.phase}{"\n"}{end}`,
+		))
+		if err != nil {
+			return fmt.Errorf("could not list pods of the release: %w", err)
+		}
+
+		pending := notRunningPods(string(out))
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().Add(updateWaitTime).After(deadline) {
+			return fmt.Errorf("%w: pods not running: %s", ErrTimeout, strings.Join(pending, ", "))
+		}
+		time.Sleep(updateWaitTime)
+	}
 }
 
-// helm lint $CHARTPATH -i
-func (p Plugin) lintPackage() error {
-	args := []string{
-		helmBin,
-		"lint",
-		p.ChartPath,
+// notRunningPods returns the pods of name=phase lines, which are neither
+// running nor completed
+func notRunningPods(out string) []string {
+	var pods []string
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[1] != "Running" && kv[1] != "Succeeded" {
+			pods = append(pods, fmt.Sprintf("%s (%s)", kv[0], kv[1]))
+		}
 	}
+	return pods
+}
 
-	args = append(args, p.createValueFileArgs()...)
+// printNotes prints the NOTES.txt of the deployed release to stdout.
+// helm get notes $RELEASE --namespace $NAMESPACE
+func (p Plugin) printNotes() error {
+	cmd := exec.Command(helmBin, "get", "notes", p.Release, "--namespace", p.Namespace)
+	cmd.Stdout = os.Stdout
+	return p.run(cmd)
+}
+
+// fetchSecretManagerValue fetches the secret of a key=secret version entry
+// from Secret Manager and returns the quoted key=value argument for --set-string.
+// The value is masked in all logs.
+// gcloud secrets versions access projects/$PROJECT/secrets/$SECRET/versions/$VERSION
+func (p Plugin) fetchSecretManagerValue(entry string) (string, error) {
+	kv := strings.SplitN(entry, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return "", fmt.Errorf("secret manager secret '%s' is not a key=secret version pair", entry)
+	}
 
-	return run(exec.Command("/bin/sh", "-c", strings.Join(args, " ")), p.Debug)
+	out, err := p.output(p.gcloudCommand("secrets", "versions", "access", kv[1]))
+	if err != nil {
+		return "", fmt.Errorf("could not access secret for key '%s': %w", kv[0], err)
+	}
+	value := helmEscape(string(out))
+	maskQuoted(value)
+	return shellQuote(kv[0] + "=" + value), nil
 }
 
-func (p Plugin) dependencyUpdate() error {
-	return run(exec.Command(helmBin, "dependency", "update", p.ChartPath), p.Debug)
+// lookupK8sValue reads the value of a key=kind/name/jsonpath entry from the
+// resource in the namespace and returns the quoted key=value argument for
+// --set-string. Secret data is base64 decoded. The value is masked in all logs.
+// kubectl get $KIND $NAME --namespace $NAMESPACE --output jsonpath={$JSONPATH}
+func (p Plugin) lookupK8sValue(entry string) (string, error) {
+	key, kind, name, path, err := parseK8sValue(entry)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := p.output(exec.Command(kubectlBin, "get", kind, name,
+		"--namespace", p.Namespace,
+		"--output", fmt.Sprintf("jsonpath={%s}", path),
+	))
+	if err != nil {
+		return "", fmt.Errorf("could not look up value for key '%s': %w", key, err)
+	}
+	value := string(out)
+	if (kind == "secret" || kind == "secrets") && strings.HasPrefix(path, ".data.") {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("could not decode secret value for key '%s': %w", key, err)
+		}
+		value = string(decoded)
+	}
+	value = helmEscape(value)
+	maskQuoted(value)
+	return shellQuote(key + "=" + value), nil
 }
 
-func (p Plugin) createValueFileArgs() []string {
-	var args []string
-	if len(p.ValueFiles) > 0 {
-		for _, f := range p.ValueFiles {
-			args = append(args, "-f", f)
+// parseK8sValue parses a key=kind/name/jsonpath entry of ValuesFromK8s
+func parseK8sValue(entry string) (key, kind, name, path string, err error) {
+	kv := strings.SplitN(entry, "=", 2)
+	if len(kv) == 2 {
+		ref := strings.SplitN(kv[1], "/", 3)
+		if kv[0] != "" && len(ref) == 3 && ref[0] != "" && ref[1] != "" && strings.HasPrefix(ref[2], ".") {
+			return kv[0], strings.ToLower(ref[0]), ref[1], ref[2], nil
 		}
 	}
-	if len(p.Values) > 0 {
-		args = append(args, "--set", strings.Join(p.Values, ","))
+	return "", "", "", "", fmt.Errorf("value from k8s '%s' is not of the form key=kind/name/.json.path", entry)
+}
+
+// helmEscape escapes the characters with a special meaning in --set values
+func helmEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`).Replace(s)
+}
+
+// secretFormat returns the sops format of the secret file. Value files are
+// yaml unless they have a .json extension; the format is always passed
+// explicitly, because sops treats files with unknown extensions as binary.
+// Partially encrypted files keep their unencrypted keys as is.
+func secretFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return "json"
 	}
-	return args
+	return "yaml"
 }
 
-func (p Plugin) addRepo() error {
-	if err := run(exec.Command(helmBin, "repo", "add", "stable", p.HelmStableRepo), p.Debug); err != nil {
-		return fmt.Errorf("could not add stable repo '%s': %w", p.HelmStableRepo, err)
+// downloadChart downloads the chart archive of the ChartURL into a temporary
+// file and returns the name of the file. The download fails after the timeout.
+func (p Plugin) downloadChart() (string, error) {
+	client := http.Client{Timeout: p.timeout()}
+	resp, err := client.Get(p.ChartURL)
+	if err != nil {
+		return "", err
 	}
-	if err := run(exec.Command(helmBin, "repo", "update"), p.Debug); err != nil {
-		return fmt.Errorf("could not update repos: %w", err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code %d", resp.StatusCode)
 	}
-	return nil
+
+	tmp, err := ioutil.TempFile(p.tempDir(""), "chart-*.tgz")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp file for the chart: %w", err)
+	}
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return tmp.Name(), fmt.Errorf("could not write chart to temp file: %w", err)
+	}
+	return tmp.Name(), tmp.Close()
 }
 
-// helm upgrade $PACKAGE $PACKAGE-$PLUGIN_CHART_VERSION.tgz -i
-func (p Plugin) deployPackage() error {
-	// We need to create the namespace because Helm 3 does not create the namespace for us anymore.
-	if err := createNamespace(p.Namespace, p.Debug); err != nil {
-		return fmt.Errorf("could not create namespace: %w", err)
+// dumpFailedPodLogs prints the logs of all failed pods of the release, which
+// are most likely failed hooks. Errors are only logged, because this is
+// called while handling a failed deploy.
+func (p Plugin) dumpFailedPodLogs() {
+	out, err := p.output(exec.Command(kubectlBin, "get", "pods",
+		"--namespace", p.Namespace,
+		"--selector", fmt.Sprintf("app.kubernetes.io/instance=%s", p.Release),
+		"--field-selector", "status.phase=Failed",
+		"--output", "name",
+	))
+	if err != nil {
+		log.Printf("could not list failed pods: %v", err)
+		return
 	}
 
-	args := []string{
-		helmBin,
-		"upgrade",
-		p.Release,
-		fmt.Sprintf("%s-%s.tgz", p.Package, p.ChartVersion),
+	for _, pod := range strings.Fields(string(out)) {
+		log.Printf("logs of failed pod %s:", pod)
+		cmd := exec.Command(kubectlBin, "logs", pod, "--namespace", p.Namespace, "--all-containers")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := p.run(cmd); err != nil {
+			log.Printf("could not get logs of pod %s: %v", pod, err)
+		}
 	}
+}
 
-	args = append(args, p.createValueFileArgs()...)
+// dumpWaitDiagnostics prints the events of the namespace and describes the
+// pods of the release that are not ready, to find out why waiting for the
+// release timed out.
+// kubectl get events --namespace $NAMESPACE --sort-by=.lastTimestamp
+func (p Plugin) dumpWaitDiagnostics() {
+	log.Printf("events of namespace %s:", p.Namespace)
+	cmd := exec.Command(kubectlBin, "get", "events", "--namespace", p.Namespace, "--sort-by=.lastTimestamp")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := p.run(cmd); err != nil {
+		log.Printf("could not get events: %v", err)
+	}
 
-	var tempFiles []string
-	defer func() {
-		for _, f := range tempFiles {
-			if err := os.Remove(f); err != nil {
-				fmt.Printf("could not remove temp file: %v", err)
-			}
+	out, err := p.output(exec.Command(kubectlBin, "get", "pods",
+		"--namespace", p.Namespace,
+		"--selector", fmt.Sprintf("app.kubernetes.io/instance=%s", p.Release),
+		"--output", `jsonpath={range .items[*]}{.metadata.name}={.status.phase}/{.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}`,
+	))
+	if err != nil {
+		log.Printf("could not list pods of the release: %v", err)
+		return
+	}
+
+	for _, pod := range notReadyPods(string(out)) {
+		log.Printf("pod %s is not ready:", pod)
+		cmd := exec.Command(kubectlBin, "describe", "pod", pod, "--namespace", p.Namespace)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := p.run(cmd); err != nil {
+			log.Printf("could not describe pod %s: %v", pod, err)
 		}
-	}()
-	for _, f := range p.Secrets {
-		cleartext, err := sops_decrypt.File(f, "yaml")
-		if err != nil {
-			return fmt.Errorf("could not decrypt secret file: %w", err)
+	}
+}
+
+// notReadyPods returns the pods of name=phase/ready lines, which are
+// neither ready nor completed
+func notReadyPods(out string) []string {
+	var pods []string
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
 		}
-		tmp, err := ioutil.TempFile(".", "decrypted")
-		if err != nil {
-			return fmt.Errorf("could not create temp file for the decrypted secrets: %w", err)
+		if !strings.HasPrefix(kv[1], "Succeeded/") && !strings.HasSuffix(kv[1], "/True") {
+			pods = append(pods, kv[0])
 		}
-		defer tmp.Close()
-		tempFiles = append(tempFiles, tmp.Name())
+	}
+	return pods
+}
 
-		if _, err := tmp.Write(cleartext); err != nil {
-			return fmt.Errorf("could not write temp file with decrypted secrets: %w", err)
+// helm test $PACKAGE
+func (p Plugin) testPackage() error {
+	// helm test looks up the release in the test namespace, so a missing
+	// namespace can not contain the release and is not created
+	if p.testNamespace() != p.Namespace {
+		exists, err := p.namespaceExists(p.testNamespace())
+		if err != nil {
+			return err
 		}
-		if err := tmp.Sync(); err != nil {
-			return fmt.Errorf("could not sync temp file with decrypted secrets: %w", err)
+		if !exists && !p.PrintOnly {
+			return fmt.Errorf("test namespace %s does not exist, the release must already be installed in the test namespace", p.testNamespace())
 		}
-		args = append(args, "-f", tmp.Name())
 	}
 
-	if p.Recreate {
-		args = append(args, "--recreate-pods")
+	args := []string{
+		helmBin, "test", p.Release,
+		"--namespace", p.testNamespace(),
+		"--timeout", p.timeoutArg(),
 	}
-	args = append(args, "--install")
-	args = append(args, "--namespace", p.Namespace)
+	if len(p.TestFilter) > 0 {
+		args = append(args, "--filter", shellQuote(p.testFilterArg()))
+	}
+	args = append(args, shellQuoteAll(p.HelmTestFlags)...)
+	return p.run(exec.Command("/bin/sh", "-c", strings.Join(args, " ")))
+}
 
-	if p.Wait {
-		args = append(args, "--wait", "--timeout", fmt.Sprintf("%ds", p.WaitTimeout))
+// testFilterArg builds the value of the --filter flag of helm test. Plain
+// test names are filtered by name, attribute=value expressions are passed as is.
+func (p Plugin) testFilterArg() string {
+	filters := make([]string, 0, len(p.TestFilter))
+	for _, f := range p.TestFilter {
+		if !strings.Contains(f, "=") {
+			f = "name=" + f
+		}
+		filters = append(filters, f)
 	}
-	return run(exec.Command("/bin/sh", "-c", strings.Join(args, " ")), p.Debug)
+	return strings.Join(filters, ",")
 }
 
-// helm test $PACKAGE
-func (p Plugin) testPackage() error {
-	args := []string{
-		helmBin, "test", p.Release,
-		"--namespace", p.Namespace,
-		"--timeout", fmt.Sprintf("%ds", p.WaitTimeout),
+// rollbackRelease rolls the release back to the previous revision. Releases
+// with only one revision were installed by this run and are not rolled back.
+// helm rollback $RELEASE --namespace $NAMESPACE
+func (p Plugin) rollbackRelease() error {
+	revision, err := p.releaseRevision()
+	if err != nil {
+		return err
+	}
+	if revision <= 1 {
+		log.Printf("release %s has no previous revision, skipping rollback", p.Release)
+		return nil
+	}
+
+	log.Printf("rolling back release %s to revision %d", p.Release, revision-1)
+	return p.run(exec.Command(helmBin, "rollback", p.Release, strconv.Itoa(revision-1), "--namespace", p.Namespace))
+}
+
+// releaseRevision returns the current revision of the release
+// helm status $RELEASE --namespace $NAMESPACE --output json
+func (p Plugin) releaseRevision() (int, error) {
+	out, err := p.output(exec.Command(helmBin, "status", p.Release, "--namespace", p.Namespace, "--output", "json"))
+	if err != nil {
+		return 0, fmt.Errorf("could not get release status: %w", err)
+	}
+	if p.PrintOnly {
+		return 0, nil
+	}
+
+	var status struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(out, &status); err != nil {
+		return 0, fmt.Errorf("could not parse release status: %w", err)
+	}
+	return status.Version, nil
+}
+
+// timeout returns the Timeout, or the WaitTimeout if no Timeout is set.
+// The Timeout is validated before, so it can be parsed.
+func (p Plugin) timeout() time.Duration {
+	if p.Timeout != "" {
+		d, _ := time.ParseDuration(p.Timeout)
+		return d
+	}
+	return time.Duration(p.WaitTimeout) * time.Second
+}
+
+// timeoutArg returns the value for the helm --timeout flag
+func (p Plugin) timeoutArg() string {
+	if p.Timeout != "" {
+		// helm accepts go duration strings as is
+		return p.Timeout
 	}
-	return run(exec.Command("/bin/sh", "-c", strings.Join(args, " ")), p.Debug)
+	return fmt.Sprintf("%ds", p.WaitTimeout)
+}
+
+// testNamespace returns the namespace used by the test action
+func (p Plugin) testNamespace() string {
+	if p.TestNamespace != "" {
+		return p.TestNamespace
+	}
+	return p.Namespace
 }
 
 type semVer struct {
@@ -291,6 +1993,88 @@ type helmVersions struct {
 	Server semVer `json:"server"`
 }
 
+// selectHelm makes sure the helm binary matches the HelmVersion. If the
+// default helm binary has another version, helm-$HELM_VERSION or
+// helm$HELM_VERSION (e.g. helm3) is used when it is installed.
+func (p Plugin) selectHelm() error {
+	if p.HelmVersion == "" || p.PrintOnly {
+		return nil
+	}
+
+	versions, err := p.fetchHelmVersions()
+	if err == nil && versions.Client.matches(p.HelmVersion) {
+		return nil
+	}
+	installed := "no helm"
+	if err == nil {
+		installed = "helm " + versions.Client.Version
+	}
+
+	for _, candidate := range []string{"helm-" + p.HelmVersion, "helm" + p.HelmVersion} {
+		if _, err := exec.LookPath(candidate); err == nil {
+			log.Printf("using %s instead of %s", candidate, installed)
+			helmBin = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("helm %s is required but %s is installed, install it as helm-%s in the PATH or remove helm_version", p.HelmVersion, installed, p.HelmVersion)
+}
+
+// requireHelmVersion fails if the installed helm client is older than
+// major.minor, which is required for the flag.
+func (p Plugin) requireHelmVersion(flag string, major, minor int) error {
+	if p.PrintOnly {
+		return nil
+	}
+	versions, err := p.fetchHelmVersions()
+	if err != nil {
+		return fmt.Errorf("could not determine helm version: %w", err)
+	}
+	if !versions.Client.atLeast(major, minor) {
+		return fmt.Errorf("%s requires helm %d.%d or newer, found %s", flag, major, minor, versions.Client.Version)
+	}
+	return nil
+}
+
+// matches reports whether the version is the given version or within it,
+// e.g. v3.6.3 matches 3, 3.6 and v3.6.3
+func (v semVer) matches(version string) bool {
+	have := strings.TrimPrefix(v.Version, "v")
+	want := strings.TrimPrefix(version, "v")
+	return have == want || strings.HasPrefix(have, want+".")
+}
+
+// atLeast reports whether the version is at least major.minor
+func (v semVer) atLeast(major, minor int) bool {
+	parts := strings.SplitN(strings.TrimPrefix(v.Version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	ma, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	mi, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	return ma > major || (ma == major && mi >= minor)
+}
+
+// fetchHelmVersions returns the version of the installed helm client
+// helm version --template {"client":{"version":"{{.Version}}"}}
+func (p Plugin) fetchHelmVersions() (*helmVersions, error) {
+	out, err := p.output(exec.Command(helmBin, "version", "--template", `{"client":{"version":"{{.Version}}"}}`))
+	if err != nil {
+		return nil, err
+	}
+	var v helmVersions
+	if err := json.Unmarshal(out, &v); err != nil {
+		return nil, fmt.Errorf("could not parse helm version output: %w", err)
+	}
+	return &v, nil
+}
+
 func (p Plugin) movePkg() error {
 	if err := os.Mkdir(p.Bucket, os.ModeDir); err != nil {
 		return err
@@ -339,25 +2123,170 @@ func scanNamed(str string, rg *regexp.Regexp) (map[string]string, error) {
 	return result, nil
 }
 
-func run(cmd *exec.Cmd, debug bool) error {
-	if debug {
-		log.Printf("running: %s", strings.Join(cmd.Args, " "))
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+// contains reports whether s is in list
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the command. With debug the command line and its output is
+// printed, with print only the command line is printed without running it.
+func (p Plugin) run(cmd *exec.Cmd) error {
+	helmDebug := p.addHelmDebug(cmd)
+	if p.PrintOnly {
+		log.Printf("would run: %s", sanitize(strings.Join(cmd.Args, " ")))
+		return nil
+	}
+	if p.Debug {
+		log.Printf("running: %s", sanitize(strings.Join(cmd.Args, " ")))
+	}
+	if p.Debug || helmDebug || p.logWriter != nil {
+		if cmd.Stdout == nil {
+			cmd.Stdout = os.Stdout
+		}
+		if cmd.Stderr == nil {
+			cmd.Stderr = os.Stderr
+		}
+	}
+	if logFile := p.logWriter; logFile != nil {
+		if !p.Debug {
+			// with debug the command line is already logged
+			fmt.Fprintf(logFile, "running: %s\n", sanitize(strings.Join(cmd.Args, " ")))
+		}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, logFile)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, logFile)
+	}
+
+	// the standard error is captured to detect common failure modes
+	var stderr bytes.Buffer
+	if cmd.Stderr == nil {
+		cmd.Stderr = &stderr
+	} else {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+	}
+	return classifyError(cmd.Run(), stderr.String())
+}
+
+// output runs the command and returns its standard output. With print only
+// the command line is printed and no output is returned.
+func (p Plugin) output(cmd *exec.Cmd) ([]byte, error) {
+	helmDebug := p.addHelmDebug(cmd)
+	if p.PrintOnly {
+		log.Printf("would run: %s", sanitize(strings.Join(cmd.Args, " ")))
+		return nil, nil
+	}
+	if p.Debug {
+		log.Printf("running: %s", sanitize(strings.Join(cmd.Args, " ")))
+	}
+
+	// the standard error is captured to detect common failure modes, also
+	// when it is printed for the helm debug output
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if helmDebug {
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	}
+	if logFile := p.logWriter; logFile != nil {
+		if !p.Debug {
+			fmt.Fprintf(logFile, "running: %s\n", sanitize(strings.Join(cmd.Args, " ")))
+		}
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, logFile)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, logFile)
+	}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// callers inspect the standard error of the failed command
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), classifyError(err, exitErrorOutput(err))
+}
+
+// lockedWriter is a writer which is safe for concurrent use. The LogFile is
+// written through one lockedWriter, because the standard output and error of
+// commands are copied concurrently and the namespaces are deployed in parallel.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// addHelmDebug appends --debug to helm commands when HelmDebug is enabled
+// and reports whether it did.
+func (p Plugin) addHelmDebug(cmd *exec.Cmd) bool {
+	if !p.HelmDebug {
+		return false
+	}
+	switch {
+	case len(cmd.Args) > 0 && cmd.Args[0] == helmBin:
+		cmd.Args = append(cmd.Args, "--debug")
+	case len(cmd.Args) == 3 && cmd.Args[0] == "/bin/sh" && strings.HasPrefix(cmd.Args[2], helmBin+" "):
+		cmd.Args[2] += " --debug"
+	default:
+		return false
+	}
+	return true
+}
+
+// namespaceExists reports whether the namespace exists. The check is
+// retried, as the API server can be unavailable right after the cluster
+// credentials were fetched.
+// kubectl get namespace --ignore-not-found $NAME
+func (p Plugin) namespaceExists(name string) (bool, error) {
+	var (
+		response []byte
+		err      error
+	)
+	for i := 0; i < updateRetries; i++ {
+		checkNS := exec.Command(kubectlBin, "get", "namespace", "--ignore-not-found", name)
+		response, err = p.output(checkNS)
+		// missing permissions or credentials do not go away by retrying
+		if err == nil || errors.Is(err, ErrAuthFailed) || i == updateRetries-1 {
+			break
+		}
+		log.Printf("could not check if namespace exists, retrying in %s: %v", updateWaitTime, err)
+		time.Sleep(updateWaitTime)
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not check if namespace exists: %w", err)
 	}
-	return cmd.Run()
+	return len(response) > 0, nil
 }
 
-func createNamespace(name string, debug bool) error {
-	checkNS := exec.Command(kubectlBin, "get", "namespace", "--ignore-not-found", name)
-	response, err := checkNS.CombinedOutput()
+// createNamespace creates the namespace if it does not exist and reports
+// whether it was created.
+func (p Plugin) createNamespace(name string) (bool, error) {
+	exists, err := p.namespaceExists(name)
 	if err != nil {
-		return fmt.Errorf("could not check if namespace exists: %w", err)
+		return false, err
+	}
+
+	var created bool
+	if !exists {
+		if err := p.run(exec.Command(kubectlBin, "create", "namespace", name)); err != nil {
+			return false, err
+		}
+		created = true
 	}
 
-	if len(response) == 0 {
-		return run(exec.Command(kubectlBin, "create", "namespace", name), debug)
+	if len(p.NamespaceLabels) > 0 {
+		// label new and existing namespaces, so policy tools recognize them as ours
+		args := append([]string{"label", "namespace", name}, p.NamespaceLabels...)
+		args = append(args, "--overwrite")
+		if err := p.run(exec.Command(kubectlBin, args...)); err != nil {
+			return created, fmt.Errorf("could not label namespace: %w", err)
+		}
 	}
 
-	return nil
+	return created, nil
 }
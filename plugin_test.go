@@ -0,0 +1,3515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestPlugin returns a plugin with the defaults of the parameters
+func newTestPlugin() Plugin {
+	return Plugin{
+		Actions:            []string{lintPkg},
+		ChartPath:          "chart",
+		ChartVersion:       "1.0.0",
+		Package:            "app",
+		Release:            "app",
+		Namespace:          "default",
+		WaitTimeout:        300,
+		ShowSubcommand:     "values",
+		TemplateMissingKey: missingKeyError,
+		ValueOrder:         filesFirst,
+	}
+}
+
+// fakeCommands puts fake executables of the commands in front of the PATH.
+// Every fake records its command line and runs its shell script, which can
+// keep files in $FAKE_DIR. calls returns the recorded command lines, restore
+// resets the PATH.
+func fakeCommands(t *testing.T, scripts map[string]string) (calls func() []string, restore func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "fake-bin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callFile := filepath.Join(dir, "calls")
+	for name, script := range scripts {
+		content := fmt.Sprintf("#!/bin/sh\nFAKE_DIR=%s\necho \"%s $*\" >> %s\n%s\n", dir, name, callFile, script)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	calls = func() []string {
+		b, _ := ioutil.ReadFile(callFile)
+		if len(b) == 0 {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+	restore = func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+	return calls, restore
+}
+
+// chdirTemp changes into a new temporary directory, restore changes back
+// and removes it
+func chdirTemp(t *testing.T) (dir string, restore func()) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = ioutil.TempDir("", "plugin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// captureLog returns the lines logged while f runs
+func captureLog(f func()) []string {
+	var b bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&b)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+	f()
+	return strings.Split(strings.TrimSpace(b.String()), "\n")
+}
+
+// hasCall reports whether one of the calls starts with prefix
+func hasCall(calls []string, prefix string) bool {
+	for _, c := range calls {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// deployCommand deploys with fake helm and kubectl commands and returns the
+// helm upgrade or install command line
+func deployCommand(t *testing.T, p Plugin) string {
+	t.Helper()
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm": `[ "$1" = install ] && echo "NAME: app-1234"; exit 0`,
+		"kubectl": `case "$1" in
+rollout) echo 'deployment "app" successfully rolled out' ;;
+*) echo default ;;
+esac`,
+	})
+	defer restore()
+
+	if err := p.deployPackage(); err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "helm upgrade") || strings.HasPrefix(c, "helm install") {
+			return c
+		}
+	}
+	t.Fatalf("helm upgrade was not run: %q", calls())
+	return ""
+}
+
+func TestValidateAllowedActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		allowed []string
+		wantErr bool
+	}{
+		{"no allow list", []string{lintPkg, deployPkg}, nil, false},
+		{"allowed", []string{lintPkg, deployPkg}, []string{lintPkg, deployPkg, testPkg}, false},
+		{"disallowed", []string{lintPkg, deployPkg}, []string{lintPkg}, true},
+		{"allowed with options", []string{deployPkg + ":namespace=foo"}, []string{deployPkg}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Actions = tt.actions
+			p.AllowedActions = tt.allowed
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeployPrintsNotes(t *testing.T) {
+	tests := []struct {
+		name       string
+		printNotes bool
+		helm       string
+	}{
+		{"notes", true, "exit 0"},
+		{"notes fail", true, `[ "$1" = get ] && exit 1; exit 0`},
+		{"no notes", false, "exit 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    tt.helm,
+				"kubectl": "echo default",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.PrintNotes = tt.printNotes
+			// a failure of helm get notes must not fail the deployed release
+			if err := p.deployPackage(); err != nil {
+				t.Fatalf("deployPackage() error = %v", err)
+			}
+			got := calls()
+			if !hasCall(got, "helm upgrade app app-1.0.0.tgz") {
+				t.Errorf("helm upgrade was not run: %q", got)
+			}
+			if hasCall(got, "helm get notes app --namespace default") != tt.printNotes {
+				t.Errorf("helm get notes run = %v, want %v: %q", !tt.printNotes, tt.printNotes, got)
+			}
+		})
+	}
+}
+
+func TestDevel(t *testing.T) {
+	for _, devel := range []bool{true, false} {
+		t.Run(fmt.Sprint(devel), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    "exit 0",
+				"kubectl": "echo default",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Devel = devel
+			p.ChartRef = "repo/app"
+			p.ChartVersion = "1.2.0-rc.1"
+			if err := p.deployPackage(); err != nil {
+				t.Fatalf("deployPackage() error = %v", err)
+			}
+			if err := p.showPackage(); err != nil {
+				t.Fatalf("showPackage() error = %v", err)
+			}
+			// the deploy installs a local archive, which helm takes as is
+			for _, c := range calls() {
+				if strings.HasPrefix(c, "helm upgrade") && strings.Contains(c, " --devel") {
+					t.Errorf("--devel in %q, want it only on helm show", c)
+				}
+				if strings.HasPrefix(c, "helm show") && strings.Contains(c, " --devel") != devel {
+					t.Errorf("--devel in %q is %v, want %v", c, !devel, devel)
+				}
+			}
+			if !hasCall(calls(), "helm show values repo/app --version 1.2.0-rc.1") {
+				t.Errorf("helm show was not run for the chart ref: %q", calls())
+			}
+		})
+	}
+}
+
+func TestDeployNoHooks(t *testing.T) {
+	for _, noHooks := range []bool{true, false} {
+		t.Run(fmt.Sprint(noHooks), func(t *testing.T) {
+			p := newTestPlugin()
+			p.NoHooks = noHooks
+			p.Recreate = true
+			cmd := deployCommand(t, p)
+			if strings.Contains(cmd, " --no-hooks") != noHooks {
+				t.Errorf("--no-hooks in %q is %v, want %v", cmd, !noHooks, noHooks)
+			}
+			// the flag composes with the other flags
+			if !strings.Contains(cmd, " --recreate-pods") || !strings.Contains(cmd, " --install") {
+				t.Errorf("other flags are missing in %q", cmd)
+			}
+		})
+	}
+}
+
+func TestCpPackageUserProject(t *testing.T) {
+	tests := []struct {
+		project string
+		want    string
+	}{
+		{"", "gsutil cp app-1.0.0.tgz gs://bucket"},
+		{"billing", "gsutil -u billing cp app-1.0.0.tgz gs://bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.project, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.GsutilUserProject = tt.project
+			if err := p.cpPackage("app-1.0.0.tgz", "gs://bucket"); err != nil {
+				t.Fatalf("cpPackage() error = %v", err)
+			}
+			// the content type header is set for uploads
+			if got := strings.Replace(calls()[0], " -h Content-Type:application/gzip", "", 1); got != tt.want {
+				t.Errorf("cpPackage() ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateResetThenReuseValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		reset   bool
+		flags   []string
+		wantErr bool
+	}{
+		{"reset then reuse", true, []string{"--atomic"}, false},
+		{"reuse values", false, []string{"--reuse-values"}, false},
+		{"with reuse values", true, []string{"--reuse-values"}, true},
+		{"with reset values", true, []string{"--reset-values=true"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ResetThenReuseValues = tt.reset
+			p.HelmUpgradeFlags = tt.flags
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeployResetThenReuseValues(t *testing.T) {
+	tests := []struct {
+		version string
+		wantErr bool
+	}{
+		{"v3.14.0", false},
+		{"v3.13.3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    fmt.Sprintf(`[ "$1" = version ] && echo '{"client":{"version":"%s"}}'; exit 0`, tt.version),
+				"kubectl": "echo default",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ResetThenReuseValues = true
+			err := p.deployPackage()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deployPackage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !hasCall(calls(), "helm upgrade app app-1.0.0.tgz --reset-then-reuse-values") {
+				t.Errorf("--reset-then-reuse-values was not passed: %q", calls())
+			}
+		})
+	}
+}
+
+func TestDeployThrottling(t *testing.T) {
+	tests := []struct {
+		name       string
+		burstLimit uint32
+		qps        float32
+		want       []string
+		notWant    []string
+	}{
+		{"unset", 0, 0, nil, []string{"--burst-limit", "--qps"}},
+		{"burst limit", 200, 0, []string{" --burst-limit 200"}, []string{"--qps"}},
+		{"qps", 0, 50.5, []string{" --qps 50.5"}, []string{"--burst-limit"}},
+		{"both", 300, 100, []string{" --burst-limit 300", " --qps 100"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.BurstLimit = tt.burstLimit
+			p.QPS = tt.qps
+			cmd := deployCommand(t, p)
+			for _, w := range tt.want {
+				if !strings.Contains(cmd, w) {
+					t.Errorf("%q is missing %q", cmd, w)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(cmd, w) {
+					t.Errorf("%q contains %q", cmd, w)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadChart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chart.tgz":
+			fmt.Fprint(w, "chart")
+		case "/slow.tgz":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "chart")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"/chart.tgz", false},
+		{"/missing.tgz", true},
+		{"/slow.tgz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ChartURL = srv.URL + tt.path
+			p.Timeout = "50ms"
+			f, err := p.downloadChart()
+			if f != "" {
+				defer os.Remove(f)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downloadChart() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if b, err := ioutil.ReadFile(f); err != nil || string(b) != "chart" {
+				t.Errorf("downloaded chart = %q, %v, want %q", b, err, "chart")
+			}
+		})
+	}
+}
+
+func TestDeployChartURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "chart")
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "chart-url-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPlugin()
+	p.ChartURL = srv.URL + "/app.tgz"
+	p.TempDir = dir
+	cmd := deployCommand(t, p)
+	if !strings.HasPrefix(cmd, "helm upgrade app "+filepath.Join(dir, "chart-")) {
+		t.Errorf("the downloaded chart is not deployed: %q", cmd)
+	}
+	// the downloaded chart is removed after the deploy
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files are left in the temp dir", len(files))
+	}
+}
+
+func TestDeployDumpsFailedPodLogs(t *testing.T) {
+	tests := []struct {
+		name     string
+		wait     bool
+		helm     string
+		wantLogs bool
+	}{
+		{"failed with wait", true, `[ "$1" = upgrade ] && exit 1; exit 0`, true},
+		{"failed without wait", false, `[ "$1" = upgrade ] && exit 1; exit 0`, false},
+		{"succeeded", true, "exit 0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm": tt.helm,
+				"kubectl": `case "$*" in
+*status.phase=Failed*) echo pod/hook-1 ;;
+"get namespace"*) echo default ;;
+esac`,
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Wait = tt.wait
+			p.PrintNotes = false
+			err := p.deployPackage()
+			if (err != nil) != (tt.helm != "exit 0") {
+				t.Fatalf("deployPackage() error = %v", err)
+			}
+			if got := hasCall(calls(), "kubectl logs pod/hook-1 --namespace default --all-containers"); got != tt.wantLogs {
+				t.Errorf("logs of the failed pod dumped = %v, want %v: %q", got, tt.wantLogs, calls())
+			}
+		})
+	}
+}
+
+func TestDeployGenerateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		release string
+		want    string
+	}{
+		{"generated", "", "helm install app-1.0.0.tgz --generate-name"},
+		{"release set", "app", "helm upgrade app app-1.0.0.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.GenerateName = true
+			p.Release = tt.release
+			if cmd := deployCommand(t, p); !strings.HasPrefix(cmd, tt.want) {
+				t.Errorf("deploy ran %q, want %q", cmd, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecGeneratedRelease(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    `[ "$1" = install ] && echo "NAME: app-1234"; exit 0`,
+		"kubectl": "echo default",
+		"gsutil":  "exit 0",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Actions = []string{deployPkg, testPkg}
+	p.GenerateName = true
+	p.Release = ""
+	p.Lock = true
+	p.Bucket = "charts"
+	if err := p.Exec(); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+
+	got := calls()
+	for _, want := range []string{
+		"helm install app-1.0.0.tgz --generate-name",
+		"helm test app-1234 --namespace default",
+		"gsutil rm gs://charts/locks/default/app-1234.lock",
+	} {
+		if !hasCall(got, want) {
+			t.Errorf("%q was not run: %q", want, got)
+		}
+	}
+	for _, c := range got {
+		if strings.Contains(c, "locks/default/.lock") {
+			t.Errorf("a lock without release name was used: %q", c)
+		}
+	}
+}
+
+func TestTestPackageNamespace(t *testing.T) {
+	tests := []struct {
+		testNamespace string
+		want          string
+	}{
+		{"", "helm test app --namespace default"},
+		{"tests", "helm test app --namespace tests"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testNamespace, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    "exit 0",
+				"kubectl": "echo exists",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.TestNamespace = tt.testNamespace
+			if err := p.testPackage(); err != nil {
+				t.Fatalf("testPackage() error = %v", err)
+			}
+			if !hasCall(calls(), tt.want) {
+				t.Errorf("%q was not run: %q", tt.want, calls())
+			}
+		})
+	}
+}
+
+func TestTestFilterArg(t *testing.T) {
+	tests := []struct {
+		filters []string
+		want    string
+	}{
+		{[]string{"smoke"}, "name=smoke"},
+		{[]string{"smoke", "db"}, "name=smoke,name=db"},
+		{[]string{"!name=slow", "smoke"}, "!name=slow,name=smoke"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.filters, ","), func(t *testing.T) {
+			p := newTestPlugin()
+			p.TestFilter = tt.filters
+			if got := p.testFilterArg(); got != tt.want {
+				t.Errorf("testFilterArg() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTestPackageFilter(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.TestFilter = []string{"smoke", "db"}
+	if err := p.testPackage(); err != nil {
+		t.Fatalf("testPackage() error = %v", err)
+	}
+	if want := "helm test app --namespace default --timeout 300s --filter name=smoke,name=db"; !hasCall(calls(), want) {
+		t.Errorf("%q was not run: %q", want, calls())
+	}
+}
+
+func TestTestPackageFilterQuoted(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"helm": `echo "filter: $# $8" >> "$FAKE_DIR/calls"`})
+	defer restore()
+
+	p := newTestPlugin()
+	p.TestFilter = []string{"smoke;touch injected", "!name=db $(id)"}
+	if err := p.testPackage(); err != nil {
+		t.Fatalf("testPackage() error = %v", err)
+	}
+	// the filter is a single argument and not interpreted by the shell
+	if want := "filter: 8 name=smoke;touch injected,!name=db $(id)"; !hasCall(calls(), want) {
+		t.Errorf("helm test got %q, want %q", calls(), want)
+	}
+}
+
+func TestPushBuckets(t *testing.T) {
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	p.Buckets = []string{"charts-eu", "charts", "charts-us"}
+	if got, want := p.pushBuckets(), []string{"charts", "charts-eu", "charts-us"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("pushBuckets() = %q, want %q", got, want)
+	}
+}
+
+func TestPushPackageBuckets(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"gsutil": `case "$*" in *gs://charts-us*) exit 1 ;; esac`,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	p.Buckets = []string{"charts-eu", "charts-us", "charts-asia"}
+	err := p.pushPackage()
+	if err == nil || !strings.Contains(err.Error(), "'charts-us'") {
+		t.Fatalf("pushPackage() error = %v, want the failed bucket", err)
+	}
+
+	got := calls()
+	for _, b := range []string{"charts", "charts-eu", "charts-us"} {
+		if !hasCallSuffix(got, " cp app-1.0.0.tgz gs://"+b) {
+			t.Errorf("package was not pushed to %s: %q", b, got)
+		}
+	}
+	// the push stops at the first failed bucket
+	if hasCallSuffix(got, "gs://charts-asia") {
+		t.Errorf("package was pushed after a failure: %q", got)
+	}
+}
+
+// hasCallSuffix reports whether one of the calls ends with suffix
+func hasCallSuffix(calls []string, suffix string) bool {
+	for _, c := range calls {
+		if strings.HasSuffix(c, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifySHA256(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	if err := ioutil.WriteFile("app-1.0.0.tgz", []byte("chart"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := "cc57fc1903e444cf6a726490b43b27ee9f87facc037f86872201847c565b45fb"
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+		wantErr  bool
+	}{
+		{"match", "app-1.0.0.tgz", sum, false},
+		{"upper case", "app-1.0.0.tgz", strings.ToUpper(sum), false},
+		{"mismatch", "app-1.0.0.tgz", strings.Repeat("0", 64), true},
+		{"missing file", "missing.tgz", sum, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifySHA256(tt.file, tt.expected); (err != nil) != tt.wantErr {
+				t.Errorf("verifySHA256() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPullPackageChecksum(t *testing.T) {
+	_, restoreDir := chdirTemp(t)
+	defer restoreDir()
+	// the fake copies the chart to the last argument
+	_, restore := fakeCommands(t, map[string]string{"gsutil": `for dest; do :; done; printf chart > "$dest"`})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	p.ChartSHA256 = "cc57fc1903e444cf6a726490b43b27ee9f87facc037f86872201847c565b45fb"
+	if err := p.pullPackage(); err != nil {
+		t.Errorf("pullPackage() error = %v", err)
+	}
+	p.ChartSHA256 = strings.Repeat("0", 64)
+	if err := p.pullPackage(); err == nil {
+		t.Error("pullPackage() succeeded with a checksum mismatch")
+	}
+}
+
+func TestPullPackagePrintOnly(t *testing.T) {
+	_, restoreDir := chdirTemp(t)
+	defer restoreDir()
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 1"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Bucket = "charts"
+	p.PrintOnly = true
+	p.ChartSHA256 = strings.Repeat("0", 64)
+	lines := captureLog(func() {
+		if err := p.pullPackage(); err != nil {
+			t.Errorf("pullPackage() error = %v", err)
+		}
+	})
+	if got := calls(); len(got) != 0 {
+		t.Errorf("pullPackage() ran %q with print only", got)
+	}
+	if !hasCall(lines, "would run: gsutil cp gs://charts/app-1.0.0.tgz app-1.0.0.tgz") {
+		t.Errorf("pullPackage() logged %q, want the download", lines)
+	}
+}
+
+func TestJSONValuesDecode(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{`a=1`, []string{`a=1`}},
+		{`a=1,b="x"`, []string{`a=1`, `b="x"`}},
+		{`a={"x":1,"y":[1,2]},b=[{"z":"1,2"}]`, []string{`a={"x":1,"y":[1,2]}`, `b=[{"z":"1,2"}]`}},
+		{`a="say \"hi\", bye",b=2`, []string{`a="say \"hi\", bye"`, `b=2`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var v jsonValues
+			if err := v.Decode(tt.value); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if strings.Join(v, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Decode() = %q, want %q", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateValuesJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  jsonValues
+		wantErr bool
+	}{
+		{"object", jsonValues{`a={"x":[1,2]}`}, false},
+		{"string", jsonValues{`a="x"`}, false},
+		{"invalid json", jsonValues{`a={x:1}`}, true},
+		{"no key", jsonValues{`={"x":1}`}, true},
+		{"no value", jsonValues{`a`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ValuesJSON = tt.values
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeploySetJSON(t *testing.T) {
+	p := newTestPlugin()
+	p.ValuesJSON = jsonValues{`tolerations=[{"key":"arm"}]`, `a="it's"`}
+	cmd := deployCommand(t, p)
+	// the shell removes the quotes
+	if want := ` --set-json tolerations=[{"key":"arm"}] --set-json a="it's"`; !strings.Contains(cmd, want) {
+		t.Errorf("%q does not contain %q", cmd, want)
+	}
+}
+
+func TestPushMetadata(t *testing.T) {
+	dir, restoreDir := chdirTemp(t)
+	defer restoreDir()
+	if err := os.Mkdir("chart", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the chart has no README.md
+	if err := ioutil.WriteFile(filepath.Join("chart", "values.yaml"), []byte("replicas: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.ChartPath = filepath.Join(dir, "chart")
+	if err := p.pushMetadata("charts"); err != nil {
+		t.Fatalf("pushMetadata() error = %v", err)
+	}
+	got := calls()
+	if want := fmt.Sprintf("cp %s gs://charts/app/", filepath.Join(p.ChartPath, "values.yaml")); len(got) != 1 || !strings.HasSuffix(got[0], want) {
+		t.Errorf("pushMetadata() ran %q, want only the values.yaml upload %q", got, want)
+	}
+}
+
+func TestSetupProjectLocation(t *testing.T) {
+	tests := []struct {
+		name                   string
+		zone, region, location string
+		want                   string
+	}{
+		{"zone", "europe-west1-b", "", "", "gcloud container clusters get-credentials prod --zone europe-west1-b"},
+		{"region", "", "europe-west1", "", "gcloud container clusters get-credentials prod --region europe-west1"},
+		{"location", "", "", "europe-west1", "gcloud container clusters get-credentials prod --location europe-west1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Project = "project"
+			p.Cluster = "prod"
+			p.Zone, p.Region, p.Location = tt.zone, tt.region, tt.location
+			if err := p.setupProject(); err != nil {
+				t.Fatalf("setupProject() error = %v", err)
+			}
+			if got := calls(); got[len(got)-1] != tt.want {
+				t.Errorf("setupProject() ran %q, want %q", got[len(got)-1], tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateLocation(t *testing.T) {
+	tests := []struct {
+		name                   string
+		zone, region, location string
+		wantErr                bool
+	}{
+		{"location", "", "", "europe-west1", false},
+		{"zone", "europe-west1-b", "", "", false},
+		{"zone and location", "europe-west1-b", "", "europe-west1", true},
+		{"region and location", "", "europe-west1", "europe-west1", true},
+		{"zone and region", "europe-west1-b", "europe-west1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Zone, p.Region, p.Location = tt.zone, tt.region, tt.location
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrintOnly(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 1",
+		"kubectl": "exit 1",
+		"gsutil":  "exit 1",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.PrintOnly = true
+	p.Bucket = "charts"
+	p.TestNamespace = "tests"
+	var err error
+	logged := captureLog(func() {
+		if err = p.pushPackage(); err != nil {
+			return
+		}
+		if err = p.deployPackage(); err != nil {
+			return
+		}
+		err = p.testPackage()
+	})
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("commands were run with print only: %q", got)
+	}
+	for _, want := range []string{
+		"would run: gsutil -h Content-Type:application/gzip cp app-1.0.0.tgz gs://charts",
+		"would run: kubectl get namespace --ignore-not-found default",
+		"would run: kubectl create namespace default",
+		"would run: /bin/sh -c helm upgrade app app-1.0.0.tgz --install --namespace default",
+		"would run: kubectl get namespace --ignore-not-found tests",
+		"would run: /bin/sh -c helm test app --namespace tests",
+	} {
+		if !hasCall(logged, want) {
+			t.Errorf("%q was not logged: %q", want, logged)
+		}
+	}
+}
+
+func TestPrintOnlyChartURL(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 1",
+		"kubectl": "exit 1",
+	})
+	defer restore()
+
+	// a download would fail, nothing listens on the port
+	p := newTestPlugin()
+	p.PrintOnly = true
+	p.ChartURL = "http://127.0.0.1:1/app-1.0.0.tgz"
+	var err error
+	logged := captureLog(func() { err = p.deployPackage() })
+	if err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("commands were run with print only: %q", got)
+	}
+	for _, want := range []string{
+		"would download: http://127.0.0.1:1/app-1.0.0.tgz",
+		"would run: /bin/sh -c helm upgrade app http://127.0.0.1:1/app-1.0.0.tgz --install --namespace default",
+	} {
+		if !hasCall(logged, want) {
+			t.Errorf("%q was not logged: %q", want, logged)
+		}
+	}
+}
+
+func TestPrintOnlyChartGlob(t *testing.T) {
+	_, restoreDir := chdirTemp(t)
+	defer restoreDir()
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 1",
+		"kubectl": "exit 1",
+	})
+	defer restore()
+
+	// the package of the create action does not exist
+	p := newTestPlugin()
+	p.PrintOnly = true
+	p.ChartGlob = "app-*.tgz"
+	var err error
+	logged := captureLog(func() { err = p.deployPackage() })
+	if err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("commands were run with print only: %q", got)
+	}
+	if want := "would run: /bin/sh -c helm upgrade app app-*.tgz --install --namespace default"; !hasCall(logged, want) {
+		t.Errorf("%q was not logged: %q", want, logged)
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		action  string
+		want    actionSpec
+		wantErr bool
+	}{
+		{"deploy", actionSpec{name: deployPkg}, false},
+		{"deploy:namespace=crds", actionSpec{name: deployPkg, namespace: "crds"}, false},
+		{"deploy:crds", actionSpec{}, true},
+		{"deploy:cluster=prod", actionSpec{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			got, err := parseAction(tt.action)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAction() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseAction() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActionSpecApply(t *testing.T) {
+	p := newTestPlugin()
+	if got := (actionSpec{name: deployPkg, namespace: "crds"}).apply(p); got.Namespace != "crds" {
+		t.Errorf("apply() namespace = %q, want crds", got.Namespace)
+	}
+	if got := (actionSpec{name: deployPkg}).apply(p); got.Namespace != "default" {
+		t.Errorf("apply() namespace = %q, want the plugin namespace", got.Namespace)
+	}
+	if p.Namespace != "default" {
+		t.Errorf("apply() changed the plugin namespace to %q", p.Namespace)
+	}
+}
+
+func TestExecActionNamespaces(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 0",
+		"kubectl": "echo exists",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Actions = []string{deployPkg + ":namespace=crds", deployPkg}
+	if err := p.Exec(); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	var namespaces []string
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "helm upgrade") {
+			namespaces = append(namespaces, c[strings.Index(c, "--namespace "):])
+		}
+	}
+	if want := []string{"--namespace crds", "--namespace default"}; strings.Join(namespaces, ",") != strings.Join(want, ",") {
+		t.Errorf("deploys used %q, want %q", namespaces, want)
+	}
+}
+
+func TestLintPackage(t *testing.T) {
+	tests := []struct {
+		name    string
+		quiet   bool
+		helm    string
+		wantErr string
+	}{
+		{"pass", false, "echo '1 chart(s) linted, 0 chart(s) failed'", ""},
+		{"quiet", true, "exit 0", ""},
+		{"fail", false, "echo '[ERROR] templates/: parse error'; exit 1", "lint of chart chart failed with exit code 1: [ERROR] templates/: parse error"},
+		{"fail without findings", false, "exit 2", "lint of chart chart failed with exit code 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": tt.helm})
+			defer restore()
+
+			p := newTestPlugin()
+			p.LintQuiet = tt.quiet
+			err := p.lintPackage()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("lintPackage() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := calls(); strings.Contains(got[0], " --quiet") != tt.quiet {
+				t.Errorf("--quiet in %q is %v, want %v", got[0], !tt.quiet, tt.quiet)
+			}
+		})
+	}
+}
+
+func TestCreateNamespaceRetry(t *testing.T) {
+	defer func(d time.Duration) { updateWaitTime = d }(updateWaitTime)
+	updateWaitTime = time.Millisecond
+
+	tests := []struct {
+		name        string
+		failure     string
+		wantChecks  int
+		wantCreated bool
+		wantErr     bool
+	}{
+		{"transient", "Unable to connect to the server: connection refused", 2, true, false},
+		{"forbidden", `Error from server (Forbidden): namespaces "default" is forbidden`, 1, false, true},
+		{"unauthorized", "error: You must be logged in to the server (Unauthorized)", 1, false, true},
+		{"invalid grant", `oauth2: cannot fetch token: 400 Bad Request Response: {"error": "invalid_grant"}`, 1, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the first check fails, the namespace does not exist
+			calls, restore := fakeCommands(t, map[string]string{
+				"kubectl": fmt.Sprintf(`tried="$FAKE_DIR/tried"
+if [ "$1" = get ] && [ ! -f "$tried" ]; then touch "$tried"; echo '%s' >&2; exit 1; fi`, tt.failure),
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			created, err := p.createNamespace("default")
+			if (err != nil) != tt.wantErr || created != tt.wantCreated {
+				t.Fatalf("createNamespace() = %v, %v, want %v, error %v", created, err, tt.wantCreated, tt.wantErr)
+			}
+			var checks int
+			for _, c := range calls() {
+				if strings.HasPrefix(c, "kubectl get namespace") {
+					checks++
+				}
+			}
+			if checks != tt.wantChecks {
+				t.Errorf("namespace was checked %d times, want %d", checks, tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestDeployChartGlob(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr bool
+	}{
+		{"single match", []string{"app-1.2.3.tgz"}, false},
+		{"no match", nil, true},
+		{"ambiguous", []string{"app-1.2.3.tgz", "app-1.2.4.tgz"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restoreDir := chdirTemp(t)
+			defer restoreDir()
+			for _, f := range tt.files {
+				if err := ioutil.WriteFile(f, []byte("chart"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    "exit 0",
+				"kubectl": "echo exists",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ChartGlob = "app-*.tgz"
+			err := p.deployPackage()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deployPackage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !hasCall(calls(), "helm upgrade app app-1.2.3.tgz") {
+				t.Errorf("the matched chart was not deployed: %q", calls())
+			}
+		})
+	}
+}
+
+func TestAddRepoForceUpdate(t *testing.T) {
+	for _, force := range []bool{true, false} {
+		t.Run(fmt.Sprint(force), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.HelmStableRepo = "https://charts.helm.sh/stable"
+			p.RepoForceUpdate = force
+			if err := p.addRepo(); err != nil {
+				t.Fatalf("addRepo() error = %v", err)
+			}
+			want := "helm repo add stable https://charts.helm.sh/stable"
+			if force {
+				want += " --force-update"
+			}
+			if got := calls(); got[0] != want {
+				t.Errorf("addRepo() ran %q, want %q", got[0], want)
+			}
+		})
+	}
+}
+
+func TestCreateValueFileArgsDir(t *testing.T) {
+	dir, restoreDir := chdirTemp(t)
+	defer restoreDir()
+	for _, f := range []string{"b.yaml", "a.yml", "10-base.yaml", "notes.txt"} {
+		if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := newTestPlugin()
+	p.ValueFilesDir = dir
+	p.ValueFiles = []string{"override.yaml"}
+	want := []string{
+		"-f", filepath.Join(dir, "10-base.yaml"),
+		"-f", filepath.Join(dir, "a.yml"),
+		"-f", filepath.Join(dir, "b.yaml"),
+		"-f", "override.yaml",
+	}
+	if got := p.createValueFileArgs(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("createValueFileArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestIsEmptyDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want bool
+	}{
+		{"empty", "", true},
+		{"whitespace", "\n  \n", true},
+		{"changes", "default, app, Deployment (apps) has changed:\n-  replicas: 1\n+  replicas: 2\n", false},
+		{"color codes", "\x1b[0m\n\x1b[33m\x1b[0m\n", true},
+		{"colored changes", "\x1b[33mdefault, app, Deployment (apps) has changed:\x1b[0m\n\x1b[32m+  replicas: 2\x1b[0m\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isEmptyDiff(tt.out); got != tt.want {
+				t.Errorf("isEmptyDiff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		diff    string
+		wantErr bool
+	}{
+		{"no change", "exit 0", true},
+		{"changes", "echo '+  replicas: 2'", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": tt.diff})
+			defer restore()
+
+			p := newTestPlugin()
+			if err := p.checkChanges("app-1.0.0.tgz", nil); (err != nil) != tt.wantErr {
+				t.Errorf("checkChanges() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if want := "helm diff upgrade app app-1.0.0.tgz"; !hasCall(calls(), want) {
+				t.Errorf("%q was not run: %q", want, calls())
+			}
+		})
+	}
+}
+
+func TestGsutilArgsStorageEndpoint(t *testing.T) {
+	p := newTestPlugin()
+	p.StorageEndpoint = "storage.example.com"
+	want := []string{
+		"-o", "Credentials:gs_host=storage.example.com",
+		"-o", "Credentials:gs_json_host=storage.example.com",
+	}
+	if got := p.gsutilArgs(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("gsutilArgs() = %q, want %q", got, want)
+	}
+
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+	defer restore()
+	if err := p.cpPackage("app-1.0.0.tgz", "gs://charts"); err != nil {
+		t.Fatalf("cpPackage() error = %v", err)
+	}
+	if got := calls(); !strings.HasPrefix(got[0], "gsutil "+strings.Join(want, " ")+" ") {
+		t.Errorf("cpPackage() ran %q without the endpoint", got[0])
+	}
+}
+
+func TestDeploySetEscaping(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{"plain", []string{"a=1", "b=2"}, " --set a=1,b=2 "},
+		{"escaped comma", []string{`hosts=a\,b`, "c=3"}, ` --set hosts=a\,b,c=3 `},
+		{"special characters", []string{"msg=it's $HOME; `id`"}, " --set msg=it's $HOME; `id` "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Values = tt.values
+			// the fake records the arguments after the shell parsed them
+			if cmd := deployCommand(t, p); !strings.Contains(cmd, tt.want) {
+				t.Errorf("%q does not contain %q", cmd, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployPrintMergedValues(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 0",
+		"kubectl": "echo exists",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.PrintMergedValues = true
+	if err := p.deployPackage(); err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+	var upgrades []string
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "helm upgrade") {
+			upgrades = append(upgrades, c)
+		}
+	}
+	if len(upgrades) != 2 || !strings.Contains(upgrades[0], " --dry-run --debug") || strings.Contains(upgrades[1], "--dry-run") {
+		t.Errorf("the preview did not run before the deploy: %q", upgrades)
+	}
+}
+
+func TestDeployPrintMergedValuesSecrets(t *testing.T) {
+	defer resetMasked()()
+	calls, restore := fakeCommands(t, map[string]string{
+		"gcloud": `printf 'pa55word'`,
+		"helm": `case "$*" in
+*--dry-run*) printf 'COMPUTED VALUES:\nimage: app\nurl: https://user:pa55word@db\nHOOKS:\n' ;;
+esac`,
+		"kubectl": "echo exists",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.PrintMergedValues = true
+	p.Values = []string{"image=app"}
+	p.SecretManagerSecrets = []string{"db.password=projects/p/secrets/db/versions/latest"}
+	var err error
+	stdout := captureStdout(t, func() { err = p.deployPackage() })
+	if err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "helm upgrade") && strings.Contains(c, "--dry-run") && strings.Contains(c, "db.password") {
+			t.Errorf("the preview got the secrets: %q", c)
+		}
+	}
+	if strings.Contains(stdout, "pa55word") {
+		t.Errorf("the merged values contain the secret:\n%s", stdout)
+	}
+	if !strings.Contains(stdout, "merged values:\nimage: app\nurl: https://user:****@db\n") {
+		t.Errorf("printed %q, want the redacted merged values", stdout)
+	}
+}
+
+func TestSetupProjectConnectGateway(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		want     string
+	}{
+		{"global", "", "gcloud container fleet memberships get-credentials prod-membership"},
+		{"location", "europe-west1", "gcloud container fleet memberships get-credentials prod-membership --location europe-west1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Project = "project"
+			p.UseConnectGateway = true
+			p.MembershipName = "prod-membership"
+			p.Location = tt.location
+			if err := p.setupProject(); err != nil {
+				t.Fatalf("setupProject() error = %v", err)
+			}
+			if got := calls(); got[len(got)-1] != tt.want {
+				t.Errorf("setupProject() ran %q, want %q", got[len(got)-1], tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateConnectGateway(t *testing.T) {
+	p := newTestPlugin()
+	p.UseConnectGateway = true
+	if err := p.validate(); err == nil {
+		t.Error("validate() succeeded without a membership name")
+	}
+	p.MembershipName = "prod-membership"
+	if err := p.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+}
+
+func TestDependencyUpdateSkipRefresh(t *testing.T) {
+	for _, skip := range []bool{true, false} {
+		t.Run(fmt.Sprint(skip), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.DependencySkipRefresh = skip
+			if err := p.dependencyUpdate(); err != nil {
+				t.Fatalf("dependencyUpdate() error = %v", err)
+			}
+			want := "helm dependency update chart"
+			if skip {
+				want += " --skip-refresh"
+			}
+			if got := calls(); got[0] != want {
+				t.Errorf("dependencyUpdate() ran %q, want %q", got[0], want)
+			}
+		})
+	}
+}
+
+func TestValidateManifests(t *testing.T) {
+	tests := []struct {
+		name    string
+		kubectl string
+		wantErr string
+	}{
+		{"valid", `sed 's/^/stdin: /' >> "$FAKE_DIR/calls"`, ""},
+		{"invalid", `sed 's/^/stdin: /' >> "$FAKE_DIR/calls"; echo 'error: unknown field "replica"' >&2; exit 1`, `unknown field "replica"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    "echo 'kind: ConfigMap'",
+				"kubectl": tt.kubectl,
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ServerSideApply = true
+			err := p.validateManifests("app-1.0.0.tgz", []string{"-f", "values.yaml"})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("validateManifests() error = %v, want %q", err, tt.wantErr)
+			}
+
+			got := calls()
+			if want := "helm template app app-1.0.0.tgz -f values.yaml --namespace default"; got[0] != want {
+				t.Errorf("rendered with %q, want %q", got[0], want)
+			}
+			if want := "kubectl apply --dry-run=server --validate=true --namespace default -f - --server-side"; got[1] != want {
+				t.Errorf("validated with %q, want %q", got[1], want)
+			}
+			// the rendered manifests are piped to kubectl
+			if len(got) != 3 || got[2] != "stdin: kind: ConfigMap" {
+				t.Errorf("kubectl did not get the manifests on stdin: %q", got)
+			}
+		})
+	}
+}
+
+func TestAddHelmDebug(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		want  []string
+		added bool
+	}{
+		{"helm", []string{"helm", "lint", "chart"}, []string{"helm", "lint", "chart", "--debug"}, true},
+		{"shell", []string{"/bin/sh", "-c", "helm upgrade app chart"}, []string{"/bin/sh", "-c", "helm upgrade app chart --debug"}, true},
+		{"kubectl", []string{"kubectl", "get", "pods"}, []string{"kubectl", "get", "pods"}, false},
+		{"shell without helm", []string{"/bin/sh", "-c", "kubectl get pods"}, []string{"/bin/sh", "-c", "kubectl get pods"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.HelmDebug = true
+			cmd := exec.Command(tt.args[0], tt.args[1:]...)
+			if added := p.addHelmDebug(cmd); added != tt.added {
+				t.Errorf("addHelmDebug() = %v, want %v", added, tt.added)
+			}
+			if strings.Join(cmd.Args, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("addHelmDebug() args = %q, want %q", cmd.Args, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmDebugLogging(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.HelmDebug = true
+	logged := captureLog(func() {
+		if err := p.lintPackage(); err != nil {
+			t.Errorf("lintPackage() error = %v", err)
+		}
+	})
+	if got := calls(); got[0] != "helm lint chart --debug" {
+		t.Errorf("lintPackage() ran %q, want helm debug", got[0])
+	}
+	// the command lines are only logged with the plugin debug
+	if hasCall(logged, "running:") {
+		t.Errorf("command lines were logged without debug: %q", logged)
+	}
+}
+
+func TestExecAutoRollback(t *testing.T) {
+	tests := []struct {
+		name         string
+		autoRollback bool
+		revision     int
+		wantRollback bool
+	}{
+		{"upgrade", true, 3, true},
+		{"first install", true, 1, false},
+		{"disabled", false, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm": fmt.Sprintf(`case "$1" in
+test) echo 'test failed' >&2; exit 1 ;;
+status) echo '{"version":%d}' ;;
+esac`, tt.revision),
+				"kubectl": "echo exists",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Actions = []string{deployPkg, testPkg}
+			p.AutoRollbackOnTestFailure = tt.autoRollback
+			// the error of the tests is returned also after a rollback
+			if err := p.Exec(); err == nil || !strings.Contains(err.Error(), "exit status 1") {
+				t.Fatalf("Exec() error = %v, want the test failure", err)
+			}
+			want := fmt.Sprintf("helm rollback app %d --namespace default", tt.revision-1)
+			if got := hasCall(calls(), want); got != tt.wantRollback {
+				t.Errorf("rolled back = %v, want %v: %q", got, tt.wantRollback, calls())
+			}
+		})
+	}
+}
+
+func TestCreateNamespaceLabels(t *testing.T) {
+	tests := []struct {
+		name        string
+		kubectl     string
+		wantCreated bool
+	}{
+		{"existing", `[ "$1" = get ] && echo default; exit 0`, false},
+		{"new", "exit 0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"kubectl": tt.kubectl})
+			defer restore()
+
+			p := newTestPlugin()
+			p.NamespaceLabels = []string{"app.kubernetes.io/managed-by=drone", "team=platform"}
+			created, err := p.createNamespace("default")
+			if err != nil || created != tt.wantCreated {
+				t.Fatalf("createNamespace() = %v, %v, want %v", created, err, tt.wantCreated)
+			}
+			got := calls()
+			if hasCall(got, "kubectl create namespace default") != tt.wantCreated {
+				t.Errorf("namespace created = %v, want %v: %q", !tt.wantCreated, tt.wantCreated, got)
+			}
+			if want := "kubectl label namespace default app.kubernetes.io/managed-by=drone team=platform --overwrite"; got[len(got)-1] != want {
+				t.Errorf("namespace labeled with %q, want %q", got[len(got)-1], want)
+			}
+		})
+	}
+}
+
+func TestWaitForRollout(t *testing.T) {
+	// the rollout completes with the second poll
+	calls, restore := fakeCommands(t, map[string]string{
+		"kubectl": `case "$*" in
+"get deployments"*) echo deployment/app ;;
+"rollout status"*)
+	if [ -f "$FAKE_DIR/polled" ]; then echo 'deployment "app" successfully rolled out'; exit 0; fi
+	touch "$FAKE_DIR/polled"; echo 'Waiting for deployment "app" rollout to finish' ;;
+esac`,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Wait = true
+	p.WaitInterval = 1
+	start := time.Now()
+	if err := p.waitForRollout(); err != nil {
+		t.Fatalf("waitForRollout() error = %v", err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("waitForRollout() polled again after %s, want the interval of 1s", d)
+	}
+	var polls int
+	for _, c := range calls() {
+		if c == "kubectl rollout status deployment/app --namespace default --watch=false" {
+			polls++
+		}
+	}
+	if polls != 2 {
+		t.Errorf("rollout status was polled %d times, want 2", polls)
+	}
+}
+
+func TestWaitForRolloutTimeout(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{
+		"kubectl": `[ "$1" = get ] && echo deployment/app; exit 0`,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.WaitInterval = 1
+	p.Timeout = "1s"
+	if err := p.waitForRollout(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("waitForRollout() error = %v, want %v", err, ErrTimeout)
+	}
+}
+
+func TestDeployCustomWait(t *testing.T) {
+	p := newTestPlugin()
+	p.Wait = true
+	p.WaitInterval = 5
+	// the custom wait replaces helm --wait
+	if cmd := deployCommand(t, p); strings.Contains(cmd, "--wait") {
+		t.Errorf("%q contains --wait with a wait interval", cmd)
+	}
+}
+
+func TestValidateShowSubcommand(t *testing.T) {
+	tests := []struct {
+		subcommand string
+		wantErr    bool
+	}{
+		{"chart", false},
+		{"values", false},
+		{"readme", false},
+		{"all", false},
+		{"crds", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subcommand, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ShowSubcommand = tt.subcommand
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShowPackage(t *testing.T) {
+	tests := []struct {
+		name       string
+		subcommand string
+		chartRef   string
+		version    string
+		want       string
+	}{
+		{"chart ref", "values", "bitnami/redis", "17.0.0", "helm show values bitnami/redis --version 17.0.0"},
+		{"local chart", "readme", "", "", "helm show readme chart"},
+		{"all", "all", "bitnami/redis", "", "helm show all bitnami/redis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ShowSubcommand = tt.subcommand
+			p.ChartRef = tt.chartRef
+			p.ChartVersion = tt.version
+			if err := p.showPackage(); err != nil {
+				t.Fatalf("showPackage() error = %v", err)
+			}
+			if got := calls(); got[0] != tt.want {
+				t.Errorf("showPackage() ran %q, want %q", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployServerSideApply(t *testing.T) {
+	tests := []struct {
+		version string
+		wantErr bool
+	}{
+		{"v4.0.0", false},
+		{"v3.16.2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    fmt.Sprintf(`[ "$1" = version ] && echo '{"client":{"version":"%s"}}'; exit 0`, tt.version),
+				"kubectl": "echo exists",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ServerSideApply = true
+			if err := p.deployPackage(); (err != nil) != tt.wantErr {
+				t.Fatalf("deployPackage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !hasCall(calls(), "helm upgrade app app-1.0.0.tgz --server-side --install") {
+				t.Errorf("--server-side was not passed: %q", calls())
+			}
+		})
+	}
+}
+
+func TestPushPackageIfExists(t *testing.T) {
+	const (
+		exists    = `[ "$1" = stat ] && echo 'gs://charts/app-1.0.0.tgz:'; exit 0`
+		notExists = `[ "$1" = stat ] && echo 'CommandException: No URLs matched: gs://charts/app-1.0.0.tgz' >&2 && exit 1; exit 0`
+		failing   = `[ "$1" = stat ] && echo 'AccessDeniedException: 403' >&2 && exit 1; exit 0`
+	)
+	tests := []struct {
+		name          string
+		gsutil        string
+		skip, errorIf bool
+		wantPush      bool
+		wantErr       bool
+	}{
+		{"skip exists", exists, true, false, false, false},
+		{"skip not exists", notExists, true, false, true, false},
+		{"error exists", exists, false, true, false, true},
+		{"error not exists", notExists, false, true, true, false},
+		{"stat fails", failing, true, false, false, true},
+		{"no check", exists, false, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gsutil": tt.gsutil})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Bucket = "charts"
+			p.SkipIfExists = tt.skip
+			p.ErrorIfExists = tt.errorIf
+			if err := p.pushPackage(); (err != nil) != tt.wantErr {
+				t.Fatalf("pushPackage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := calls()
+			if hasCall(got, "gsutil stat gs://charts/app-1.0.0.tgz") != (tt.skip || tt.errorIf) {
+				t.Errorf("existence check in %q, want %v", got, tt.skip || tt.errorIf)
+			}
+			if pushed := hasCallSuffix(got, "cp app-1.0.0.tgz gs://charts"); pushed != tt.wantPush {
+				t.Errorf("pushed = %v, want %v", pushed, tt.wantPush)
+			}
+		})
+	}
+}
+
+func TestDeployValueOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{filesFirst, " -f values.yaml --set-string password=s3cret "},
+		{secretsFirst, " --set-string password=s3cret -f values.yaml "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    "exit 0",
+				"kubectl": "echo exists",
+				"gcloud":  "printf s3cret",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ValueOrder = tt.order
+			p.ValueFiles = []string{"values.yaml"}
+			p.SecretManagerSecrets = []string{"password=projects/p/secrets/db/versions/1"}
+			if err := p.deployPackage(); err != nil {
+				t.Fatalf("deployPackage() error = %v", err)
+			}
+			for _, c := range calls() {
+				if strings.HasPrefix(c, "helm upgrade") && !strings.Contains(c, tt.want) {
+					t.Errorf("%q does not contain %q", c, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateValueOrder(t *testing.T) {
+	p := newTestPlugin()
+	p.ValueOrder = "secrets-last"
+	if err := p.validate(); err == nil {
+		t.Error("validate() succeeded with an unknown value order")
+	}
+}
+
+func TestDeployReplace(t *testing.T) {
+	tests := []struct {
+		name        string
+		release     string
+		wantReplace bool
+	}{
+		{"install", "", true},
+		{"upgrade", "app", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Replace = true
+			p.GenerateName = true
+			p.Release = tt.release
+			var cmd string
+			logged := captureLog(func() { cmd = deployCommand(t, p) })
+			if strings.Contains(cmd, " --replace") != tt.wantReplace {
+				t.Errorf("--replace in %q is %v, want %v", cmd, !tt.wantReplace, tt.wantReplace)
+			}
+			// helm upgrade has no --replace, so it is only warned about
+			if got := hasCall(logged, "warning: --replace"); got == tt.wantReplace {
+				t.Errorf("warning logged = %v, want %v", got, !tt.wantReplace)
+			}
+		})
+	}
+}
+
+func TestTestPackageMissingNamespace(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 0",
+		"kubectl": "exit 0",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.TestNamespace = "tests"
+	err := p.testPackage()
+	if err == nil || !strings.HasPrefix(err.Error(), "test namespace tests does not exist") {
+		t.Fatalf("testPackage() error = %v, want the missing namespace", err)
+	}
+	// the release can not be in a new namespace, so it is neither created nor tested
+	want := []string{"kubectl get namespace --ignore-not-found tests"}
+	if got := calls(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("testPackage() ran %q, want %q", got, want)
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		flag    string
+		wantErr bool
+	}{
+		{"--atomic", false},
+		{"--description=release-1.2", false},
+		{"-o=json", false},
+		{"atomic", true},
+		{"--description=x;rm -rf /", false},
+		{"--description=x #", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			if err := validateFlags([]string{tt.flag}); (err != nil) != tt.wantErr {
+				t.Errorf("validateFlags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtraFlags(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "exit 0",
+		"kubectl": "echo exists",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.HelmUpgradeFlags = []string{"--atomic", "--description=release"}
+	p.HelmTestFlags = []string{"--logs"}
+	p.HelmLintFlags = []string{"--strict"}
+	for _, f := range []func() error{p.lintPackage, p.deployPackage, p.testPackage} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := calls()
+	for _, want := range []string{
+		"helm lint chart --strict",
+		"helm upgrade app app-1.0.0.tgz --install --namespace default --atomic --description=release",
+		"helm test app --namespace default --timeout 300s --logs",
+	} {
+		if !hasCall(got, want) {
+			t.Errorf("%q was not run: %q", want, got)
+		}
+	}
+}
+
+func TestExtraFlagsQuoted(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    `[ "$1" = upgrade ] && for a in "$@"; do echo "arg: $a" >> "$FAKE_DIR/calls"; done; exit 0`,
+		"kubectl": "echo exists",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Wait = true
+	p.HelmUpgradeFlags = []string{"--description=x #", "--description=a b", "--description=$(id)"}
+	if err := p.deployPackage(); err != nil {
+		t.Fatal(err)
+	}
+	// every flag is a single argument and the flags after them are kept
+	got := calls()
+	for _, want := range []string{"arg: --description=x #", "arg: --description=a b", "arg: --description=$(id)", "arg: --wait"} {
+		if !contains(got, want) {
+			t.Errorf("%q was not passed: %q", want, got)
+		}
+	}
+}
+
+func TestDeployDisableOpenAPIValidation(t *testing.T) {
+	for _, disable := range []bool{true, false} {
+		t.Run(fmt.Sprint(disable), func(t *testing.T) {
+			p := newTestPlugin()
+			p.DisableOpenAPIValidation = disable
+			var cmd string
+			logged := captureLog(func() { cmd = deployCommand(t, p) })
+			if strings.Contains(cmd, " --disable-openapi-validation") != disable {
+				t.Errorf("--disable-openapi-validation in %q is %v, want %v", cmd, !disable, disable)
+			}
+			if got := hasCall(logged, "warning: OpenAPI validation is disabled"); got != disable {
+				t.Errorf("warning logged = %v, want %v", got, disable)
+			}
+		})
+	}
+}
+
+func TestKmsKey(t *testing.T) {
+	const key = "projects/p/locations/europe/keyRings/charts/cryptoKeys/upload"
+	tests := []struct {
+		key     string
+		wantErr bool
+	}{
+		{key, false},
+		{"projects/p/keyRings/charts/cryptoKeys/upload", true},
+		{"upload", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			p := newTestPlugin()
+			p.KmsKey = tt.key
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+	defer restore()
+	p := newTestPlugin()
+	p.KmsKey = key
+	if err := p.cpPackage("app-1.0.0.tgz", "gs://charts"); err != nil {
+		t.Fatalf("cpPackage() error = %v", err)
+	}
+	if got := calls(); !strings.HasPrefix(got[0], "gsutil -o GSUtil:encryption_key="+key+" ") {
+		t.Errorf("cpPackage() ran %q without the encryption key", got[0])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		timeout     string
+		waitTimeout uint32
+		want        time.Duration
+		wantArg     string
+	}{
+		{"", 300, 5 * time.Minute, "300s"},
+		{"10m", 300, 10 * time.Minute, "10m"},
+		{"1h30m", 0, 90 * time.Minute, "1h30m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timeout, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Timeout = tt.timeout
+			p.WaitTimeout = tt.waitTimeout
+			if got := p.timeout(); got != tt.want {
+				t.Errorf("timeout() = %s, want %s", got, tt.want)
+			}
+			if got := p.timeoutArg(); got != tt.wantArg {
+				t.Errorf("timeoutArg() = %q, want %q", got, tt.wantArg)
+			}
+		})
+	}
+
+	p := newTestPlugin()
+	p.Timeout = "10 minutes"
+	if err := p.validate(); err == nil {
+		t.Error("validate() succeeded with an invalid timeout")
+	}
+}
+
+func TestDeployWaitTimeout(t *testing.T) {
+	p := newTestPlugin()
+	p.Wait = true
+	p.Timeout = "10m"
+	if cmd := deployCommand(t, p); !strings.Contains(cmd, " --wait --timeout 10m") {
+		t.Errorf("%q does not wait with the timeout", cmd)
+	}
+}
+
+func TestDeployCleanupOnFirstInstallFailure(t *testing.T) {
+	const (
+		notFound = `[ "$1" = status ] && echo 'Error: release: not found' >&2 && exit 1`
+		deployed = `[ "$1" = status ] && echo '{"version":2}' && exit 0`
+	)
+	tests := []struct {
+		name          string
+		helm          string
+		wantErr       bool
+		wantUninstall bool
+	}{
+		{"first install fails", notFound + "\n[ \"$1\" = upgrade ] && exit 1; exit 0", true, true},
+		{"upgrade fails", deployed + "\n[ \"$1\" = upgrade ] && exit 1; exit 0", true, false},
+		{"first install succeeds", notFound + "\nexit 0", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    tt.helm,
+				"kubectl": "echo exists",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.CleanupOnFirstInstallFailure = true
+			if err := p.deployPackage(); (err != nil) != tt.wantErr {
+				t.Fatalf("deployPackage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := hasCall(calls(), "helm uninstall app --namespace default"); got != tt.wantUninstall {
+				t.Errorf("uninstalled = %v, want %v: %q", got, tt.wantUninstall, calls())
+			}
+		})
+	}
+}
+
+func TestUninstallFailedReleaseNoHooks(t *testing.T) {
+	tests := []struct {
+		noHooks bool
+		want    string
+	}{
+		{false, "helm uninstall app --namespace default"},
+		{true, "helm uninstall app --namespace default --no-hooks"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.noHooks), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.NoHooks = tt.noHooks
+			captureLog(p.uninstallFailedRelease)
+			if got := calls(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("uninstallFailedRelease() ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParallelCompositeUpload(t *testing.T) {
+	tests := []struct {
+		threshold string
+		wantErr   bool
+	}{
+		{"", false},
+		{"150", false},
+		{"150M", false},
+		{"2G", false},
+		{"150MB", true},
+		{"1.5G", true},
+		{"M", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.threshold, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ParallelCompositeThreshold = tt.threshold
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+	defer restore()
+	p := newTestPlugin()
+	p.ParallelCompositeThreshold = "150M"
+	p.ParallelProcessCount = 4
+	if err := p.cpPackage("app", "bucket"); err != nil {
+		t.Fatalf("cpPackage() error = %v", err)
+	}
+	want := "gsutil -o GSUtil:parallel_composite_upload_threshold=150M -o GSUtil:parallel_process_count=4 cp app bucket"
+	if got := calls(); got[0] != want {
+		t.Errorf("cpPackage() ran %q, want %q", got[0], want)
+	}
+}
+
+func TestSemVerMatches(t *testing.T) {
+	tests := []struct {
+		have    string
+		version string
+		want    bool
+	}{
+		{"v3.6.3", "3", true},
+		{"v3.6.3", "3.6", true},
+		{"v3.6.3", "v3.6.3", true},
+		{"v3.6.3", "3.6.3", true},
+		{"v3.6.3", "3.7", false},
+		{"v3.16.0", "3.1", false},
+		{"v2.17.0", "3", false},
+		{"", "3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.have+"~"+tt.version, func(t *testing.T) {
+			if got := (semVer{Version: tt.have}).matches(tt.version); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSemVerAtLeast(t *testing.T) {
+	tests := []struct {
+		have         string
+		major, minor int
+		want         bool
+	}{
+		{"v3.13.0", 3, 13, true},
+		{"v3.14.2", 3, 13, true},
+		{"v4.0.0", 3, 13, true},
+		{"v3.12.3", 3, 13, false},
+		{"v2.17.0", 3, 0, false},
+		{"3.13", 3, 13, true},
+		{"v3", 3, 0, false},
+		{"vx.13.0", 3, 13, false},
+		{"", 3, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.have, func(t *testing.T) {
+			if got := (semVer{Version: tt.have}).atLeast(tt.major, tt.minor); got != tt.want {
+				t.Errorf("atLeast(%d, %d) = %v, want %v", tt.major, tt.minor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectHelm(t *testing.T) {
+	tests := []struct {
+		name    string
+		scripts map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "installed",
+			scripts: map[string]string{"helm": `echo '{"client":{"version":"v3.6.3"}}'`},
+			want:    "helm",
+		},
+		{
+			name: "versioned binary",
+			scripts: map[string]string{
+				"helm":   `echo '{"client":{"version":"v2.17.0"}}'`,
+				"helm-3": "exit 0",
+			},
+			want: "helm-3",
+		},
+		{
+			name: "short binary",
+			scripts: map[string]string{
+				"helm":  "exit 1",
+				"helm3": "exit 0",
+			},
+			want: "helm3",
+		},
+		{
+			name:    "missing",
+			scripts: map[string]string{"helm": `echo '{"client":{"version":"v2.17.0"}}'`},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restore := fakeCommands(t, tt.scripts)
+			defer restore()
+			defer func() { helmBin = "helm" }()
+
+			p := newTestPlugin()
+			p.HelmVersion = "3"
+			err := p.selectHelm()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectHelm() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "helm v2.17.0 is installed") {
+					t.Errorf("selectHelm() error = %v, want the installed version", err)
+				}
+				return
+			}
+			if helmBin != tt.want {
+				t.Errorf("selectHelm() selected %q, want %q", helmBin, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotRunningPods(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"no pods", "", nil},
+		{"running", "app-1=Running\napp-2=Running\n", nil},
+		{"completed", "app-1=Running\nmigrate=Succeeded\n", nil},
+		{"pending", "app-1=Running\napp-2=Pending\n", []string{"app-2 (Pending)"}},
+		{"failed", "app-1=Failed\napp-2=Unknown", []string{"app-1 (Failed)", "app-2 (Unknown)"}},
+		{"malformed", "app-1\napp-2=Pending", []string{"app-2 (Pending)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notRunningPods(tt.out); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("notRunningPods() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSmokeCheck(t *testing.T) {
+	defer func(d time.Duration) { updateWaitTime = d }(updateWaitTime)
+	updateWaitTime = time.Millisecond
+
+	tests := []struct {
+		name    string
+		script  string
+		wantErr error
+	}{
+		{
+			name:   "running",
+			script: `echo "app-1=Running"; echo "migrate=Succeeded"`,
+		},
+		{
+			// the pod is running at the second poll
+			name:   "starting",
+			script: `if [ -f "$FAKE_DIR/polled" ]; then echo "app-1=Running"; else touch "$FAKE_DIR/polled"; echo "app-1=Pending"; fi`,
+		},
+		{
+			name:    "crashing",
+			script:  `echo "app-1=Failed"`,
+			wantErr: ErrTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"kubectl": tt.script})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Namespace = "apps"
+			p.Timeout = "50ms"
+			err := p.smokeCheck()
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("smokeCheck() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("smokeCheck() error = %v, want %v", err, tt.wantErr)
+			}
+			if !hasCall(calls(), "kubectl get pods --namespace apps --selector app.kubernetes.io/instance=app") {
+				t.Errorf("pods of the release were not listed: %q", calls())
+			}
+		})
+	}
+}
+
+func TestHelmEscape(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"s3cret", "s3cret"},
+		{"a,b", `a\,b`},
+		{`a\b`, `a\\b`},
+		{`a\,b`, `a\\\,b`},
+	}
+	for _, tt := range tests {
+		if got := helmEscape(tt.in); got != tt.want {
+			t.Errorf("helmEscape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFetchSecretManagerValue(t *testing.T) {
+	defer resetMasked()()
+	calls, restore := fakeCommands(t, map[string]string{"gcloud": `printf 'pa,ss'`})
+	defer restore()
+
+	tests := []struct {
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{"db.password=projects/p/secrets/db/versions/latest", `'db.password=pa\,ss'`, false},
+		{"db.password", "", true},
+		{"=projects/p/secrets/db/versions/latest", "", true},
+		{"db.password=", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			p := newTestPlugin()
+			got, err := p.fetchSecretManagerValue(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchSecretManagerValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("fetchSecretManagerValue() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := calls(); len(got) != 1 || got[0] != "gcloud secrets versions access projects/p/secrets/db/versions/latest" {
+		t.Errorf("gcloud calls = %q, want one secrets versions access", got)
+	}
+}
+
+func TestFetchSecretManagerValueQuote(t *testing.T) {
+	defer resetMasked()()
+	_, restore := fakeCommands(t, map[string]string{"gcloud": `printf '%s' "it's-s3cret"`})
+	defer restore()
+
+	p := newTestPlugin()
+	got, err := p.fetchSecretManagerValue("db.pw=projects/p/secrets/db/versions/latest")
+	if err != nil {
+		t.Fatalf("fetchSecretManagerValue() error = %v", err)
+	}
+	if want := `'db.pw=it'\''s-s3cret'`; got != want {
+		t.Errorf("fetchSecretManagerValue() = %q, want %q", got, want)
+	}
+	// the quoted form is what the logged command lines contain
+	if s := sanitize("--set-string " + got); strings.Contains(s, "s3cret") {
+		t.Errorf("secret is not masked in %q", s)
+	}
+}
+
+func TestDeploySecretManagerMasked(t *testing.T) {
+	defer resetMasked()()
+	_, restore := fakeCommands(t, map[string]string{
+		"gcloud":  `printf 'pa55word'`,
+		"helm":    "exit 0",
+		"kubectl": `echo 'deployment "app" successfully rolled out'`,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Debug = true
+	p.SecretManagerSecrets = []string{"db.password=projects/p/secrets/db/versions/latest"}
+	var err error
+	lines := captureLog(func() { err = p.deployPackage() })
+	if err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+
+	logged := false
+	for _, l := range lines {
+		if strings.Contains(l, "pa55word") {
+			t.Errorf("secret is logged: %q", l)
+		}
+		if strings.HasPrefix(l, "running: /bin/sh -c helm upgrade") && strings.Contains(l, "--set-string 'db.password=****'") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("helm upgrade with the masked secret was not logged: %q", lines)
+	}
+}
+
+func TestValidateDryRun(t *testing.T) {
+	for _, mode := range []string{"", "true", "client", "server"} {
+		p := newTestPlugin()
+		p.DryRun = mode
+		if err := p.validate(); err != nil {
+			t.Errorf("validate() with dry run %q error = %v", mode, err)
+		}
+	}
+	for _, mode := range []string{"false", "none", "Server"} {
+		p := newTestPlugin()
+		p.DryRun = mode
+		if err := p.validate(); err == nil {
+			t.Errorf("validate() accepted dry run %q", mode)
+		}
+	}
+}
+
+func TestDeployDryRun(t *testing.T) {
+	tests := []struct {
+		mode    string
+		version string
+		want    string
+		wantErr bool
+	}{
+		{"true", "v3.12.0", "--dry-run --namespace", false},
+		{"client", "v3.13.0", "--dry-run=client --namespace", false},
+		{"server", "v3.14.2", "--dry-run=server --namespace", false},
+		{"server", "v3.12.0", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"@"+tt.version, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    fmt.Sprintf(`[ "$1" = version ] && echo '{"client":{"version":"%s"}}'; exit 0`, tt.version),
+				"kubectl": "echo default",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.DryRun = tt.mode
+			p.Wait = true
+			p.WaitInterval = 1
+			p.NamespaceLabels = []string{"team=apps"}
+			err := p.deployPackage()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deployPackage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "requires helm 3.13") {
+					t.Errorf("deployPackage() error = %v, want the required helm version", err)
+				}
+				return
+			}
+
+			got := calls()
+			if !hasCall(got, "helm upgrade app app-1.0.0.tgz --install "+tt.want) {
+				t.Errorf("helm upgrade with %s was not run: %q", tt.want, got)
+			}
+			// nothing is deployed, so the rollout is not awaited
+			if hasCall(got, "kubectl rollout") {
+				t.Errorf("rollout of the dry run was awaited: %q", got)
+			}
+			// the dry run does not change the cluster
+			if hasCall(got, "kubectl create namespace") || hasCall(got, "kubectl label namespace") {
+				t.Errorf("the dry run changed the namespace: %q", got)
+			}
+		})
+	}
+}
+
+func TestUploadHeaderArgs(t *testing.T) {
+	tests := []struct {
+		file        string
+		contentType string
+		metadata    []string
+		want        string
+	}{
+		{"app-1.0.0.tgz", "", nil, "-h Content-Type:application/gzip"},
+		{"values.yaml", "", nil, "-h Content-Type:text/yaml"},
+		{"README.md", "", nil, "-h Content-Type:text/markdown"},
+		{"chart.prov", "", nil, ""},
+		{"app-1.0.0.tgz", "application/x-tar", nil, "-h Content-Type:application/x-tar"},
+		// the configured content type is only used for packages
+		{"values.yaml", "application/x-tar", nil, "-h Content-Type:text/yaml"},
+		{"README.md", "application/x-tar", nil, "-h Content-Type:text/markdown"},
+		{"chart.prov", "application/x-tar", nil, ""},
+		{"index.yaml", "", []string{"team=core", "build=1=2"}, "-h Content-Type:text/yaml -h x-goog-meta-team:core -h x-goog-meta-build:1=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+"/"+tt.contentType, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ContentType = tt.contentType
+			p.Metadata = tt.metadata
+			if got := strings.Join(p.uploadHeaderArgs(tt.file), " "); got != tt.want {
+				t.Errorf("uploadHeaderArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCpPackageHeaders(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"gsutil": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.ContentType = "application/x-tar"
+	if err := p.cpPackage("values.yaml", "gs://charts/app/values.yaml"); err != nil {
+		t.Fatalf("cpPackage() error = %v", err)
+	}
+	// downloads have no upload headers
+	if err := p.cpPackage("gs://charts/app-1.0.0.tgz", "app-1.0.0.tgz"); err != nil {
+		t.Fatalf("cpPackage() error = %v", err)
+	}
+	got := calls()
+	for i, want := range []string{
+		"gsutil -h Content-Type:text/yaml cp values.yaml gs://charts/app/values.yaml",
+		"gsutil cp gs://charts/app-1.0.0.tgz app-1.0.0.tgz",
+	} {
+		if got[i] != want {
+			t.Errorf("cpPackage() ran %q, want %q", got[i], want)
+		}
+	}
+}
+
+func TestValueReuseArgs(t *testing.T) {
+	tests := []struct {
+		name           string
+		resetThenReuse bool
+		flags          []string
+		want           string
+	}{
+		{"none", false, []string{"--atomic"}, ""},
+		{"reuse", false, []string{"--atomic", "--reuse-values"}, "--reuse-values"},
+		{"reset", false, []string{"--reset-values=true", "--force"}, "--reset-values=true"},
+		{"reset then reuse", true, []string{"--atomic"}, "--reset-then-reuse-values"},
+		{"duplicate", true, []string{"--reset-then-reuse-values"}, "--reset-then-reuse-values"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.ResetThenReuseValues = tt.resetThenReuse
+			p.HelmUpgradeFlags = tt.flags
+			if got := strings.Join(p.valueReuseArgs(), " "); got != tt.want {
+				t.Errorf("valueReuseArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployDiffReusesValues(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm": `case "$1" in
+version) echo '{"client":{"version":"v3.14.0"}}' ;;
+diff) echo '+  replicas: 2' ;;
+esac`,
+		"kubectl": `echo 'deployment "app" successfully rolled out'`,
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.FailOnNoChange = true
+	p.ResetThenReuseValues = true
+	p.Values = []string{"replicas=2"}
+	if err := p.deployPackage(); err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+
+	got := calls()
+	want := "helm diff upgrade app app-1.0.0.tgz --set replicas=2 --reset-then-reuse-values"
+	if !hasCall(got, want) {
+		t.Errorf("%q was not run: %q", want, got)
+	}
+	if !hasCall(got, "helm upgrade app app-1.0.0.tgz --set replicas=2 --reset-then-reuse-values") {
+		t.Errorf("helm upgrade does not reuse the values like the diff: %q", got)
+	}
+}
+
+func TestCheckChangesNoColor(t *testing.T) {
+	for _, noColor := range []bool{false, true} {
+		calls, restore := fakeCommands(t, map[string]string{"helm": "echo '+  replicas: 2'"})
+		p := newTestPlugin()
+		p.NoColor = &noColor
+		err := p.checkChanges("app-1.0.0.tgz", nil)
+		got := calls()
+		restore()
+		if err != nil {
+			t.Fatalf("checkChanges() error = %v", err)
+		}
+		if hasCall(got, "helm diff upgrade app app-1.0.0.tgz --no-color") != noColor {
+			t.Errorf("helm diff with no color %v ran %q", noColor, got)
+		}
+	}
+}
+
+func TestExecInCluster(t *testing.T) {
+	for _, inCluster := range []bool{false, true} {
+		calls, restore := fakeCommands(t, map[string]string{
+			"gcloud": "exit 0",
+			"helm":   "exit 0",
+		})
+		p := newTestPlugin()
+		p.InCluster = inCluster
+		p.Project = "project"
+		p.Cluster = "cluster"
+		p.Zone = "europe-west1-b"
+		err := p.Exec()
+		got := calls()
+		restore()
+		if err != nil {
+			t.Fatalf("Exec() with in cluster %v error = %v", inCluster, err)
+		}
+		if hasCall(got, "gcloud container clusters get-credentials") == inCluster {
+			t.Errorf("Exec() with in cluster %v ran %q", inCluster, got)
+		}
+		if !hasCall(got, "helm lint") {
+			t.Errorf("Exec() with in cluster %v did not lint: %q", inCluster, got)
+		}
+	}
+
+	p := newTestPlugin()
+	p.InCluster = true
+	p.UseConnectGateway = true
+	if err := p.validate(); err == nil {
+		t.Error("validate() accepted in cluster with the connect gateway")
+	}
+}
+
+func TestLintRenderCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		renderCheck bool
+		template    string
+		wantErr     string
+	}{
+		{"disabled", false, "exit 1", ""},
+		{"renders", true, "echo 'kind: Deployment'", ""},
+		{"fails", true, `echo 'Error: template: app/templates/deployment.yaml:5:3: executing "app" at <.Values.image.tag>: nil pointer' >&2; exit 1`, `chart chart fails to render: could not render chart: exit status 1: Error: template: app/templates/deployment.yaml:5:3: executing "app" at <.Values.image.tag>: nil pointer`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm": fmt.Sprintf(`[ "$1" = template ] || exit 0
+%s`, tt.template),
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.RenderCheck = tt.renderCheck
+			p.ValueFiles = []string{"values.yaml"}
+			err := p.lintPackage()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("lintPackage() error = %v, want %q", err, tt.wantErr)
+			}
+			if rendered := hasCall(calls(), "helm template app chart -f values.yaml --namespace default"); rendered != tt.renderCheck {
+				t.Errorf("chart rendered %v, want %v: %q", rendered, tt.renderCheck, calls())
+			}
+		})
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	p := newTestPlugin()
+	if got := p.tempDir("."); got != "." {
+		t.Errorf("tempDir() = %q, want the fallback", got)
+	}
+	p.TempDir = "/scratch"
+	if got := p.tempDir("."); got != "/scratch" {
+		t.Errorf("tempDir() = %q, want the temp dir", got)
+	}
+}
+
+func TestDeployTempDir(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	tempDir, err := ioutil.TempDir("", "temp-dir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	ioutil.WriteFile("values.yaml", []byte("replicas: 2\n"), 0644)
+
+	p := newTestPlugin()
+	p.TempDir = tempDir
+	p.TemplateValues = true
+	p.ValueFiles = []string{"values.yaml"}
+	cmd := deployCommand(t, p)
+
+	// the rendered values are passed from the temp dir and removed after the deploy
+	fields := strings.Fields(cmd)
+	var rendered string
+	for i, f := range fields {
+		if f == "-f" && i+1 < len(fields) {
+			rendered = fields[i+1]
+		}
+	}
+	if filepath.Dir(rendered) != tempDir {
+		t.Errorf("rendered values %q are not in the temp dir %s: %q", rendered, tempDir, cmd)
+	}
+	if _, err := os.Stat(rendered); !os.IsNotExist(err) {
+		t.Errorf("rendered values %s were not removed: %v", rendered, err)
+	}
+}
+
+func TestCreatePackageDependencyUpdate(t *testing.T) {
+	for _, update := range []bool{false, true} {
+		t.Run(fmt.Sprint(update), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.PackageDependencyUpdate = update
+			if err := p.createPackage(); err != nil {
+				t.Fatalf("createPackage() error = %v", err)
+			}
+			want := "helm package --version 1.0.0 chart"
+			if update {
+				want = "helm package --version 1.0.0 --dependency-update chart"
+			}
+			if got := calls(); len(got) != 1 || got[0] != want {
+				t.Errorf("createPackage() ran %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestValidateActions(t *testing.T) {
+	tests := []struct {
+		name     string
+		actions  []string
+		wantErr  bool
+		wantWarn bool
+	}{
+		{"known", []string{lintPkg, createPkg, deployPkg}, false, false},
+		{"unknown", []string{lintPkg, "deploi"}, true, false},
+		{"unknown with namespace", []string{"deploi:namespace=staging"}, true, false},
+		{"duplicate", []string{lintPkg, deployPkg, lintPkg}, false, true},
+		{"same action in other namespaces", []string{"deploy:namespace=staging", "deploy:namespace=production"}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Actions = tt.actions
+			var err error
+			lines := captureLog(func() { err = p.validate() })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if warned := strings.Contains(strings.Join(lines, "\n"), "is given more than once"); warned != tt.wantWarn {
+				t.Errorf("validate() logged %q, want warning %v", lines, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestExecUnknownAction(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Actions = []string{lintPkg, "deploi"}
+	if err := p.Exec(); err == nil || !strings.Contains(err.Error(), "unknown action 'deploi'") {
+		t.Errorf("Exec() error = %v, want the unknown action", err)
+	}
+	// nothing runs before the unknown action is rejected
+	if got := calls(); len(got) != 0 {
+		t.Errorf("Exec() ran %q", got)
+	}
+}
+
+func TestSnapshotRelease(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	calls, restoreCommands := fakeCommands(t, map[string]string{
+		"helm": `[ "$3" = missing ] && { echo 'Error: release: not found' >&2; exit 1; }
+echo "REVISION: 3"`,
+		"gsutil": `while [ "$1" != cp ]; do shift; done
+sed 's/^/uploaded: /' "$2" >> "$FAKE_DIR/calls"`,
+	})
+	defer restoreCommands()
+
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"default file", "", "app-snapshot.yaml"},
+		{"file", "snapshots/app.yaml", "snapshots/app.yaml"},
+	}
+	os.Mkdir("snapshots", 0755)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Namespace = "apps"
+			p.SnapshotFile = tt.file
+			if err := p.snapshotRelease(); err != nil {
+				t.Fatalf("snapshotRelease() error = %v", err)
+			}
+			if b, err := ioutil.ReadFile(tt.want); err != nil || string(b) != "REVISION: 3\n" {
+				t.Errorf("snapshot %s = %q, %v, want the release", tt.want, b, err)
+			}
+		})
+	}
+	if got := calls(); !hasCall(got, "helm get all app --namespace apps") {
+		t.Errorf("release was not read: %q", got)
+	}
+
+	p := newTestPlugin()
+	p.SnapshotFile = "gs://backups/app.yaml"
+	if err := p.snapshotRelease(); err != nil {
+		t.Fatalf("snapshotRelease() error = %v", err)
+	}
+	got := calls()
+	if !hasCallSuffix(got, " gs://backups/app.yaml") || !hasCall(got, "uploaded: REVISION: 3") {
+		t.Errorf("snapshot was not uploaded: %q", got)
+	}
+
+	p = newTestPlugin()
+	p.Release = "missing"
+	p.SnapshotFile = "missing.yaml"
+	if err := p.snapshotRelease(); err != nil {
+		t.Errorf("snapshotRelease() of a missing release error = %v", err)
+	}
+	if _, err := os.Stat("missing.yaml"); !os.IsNotExist(err) {
+		t.Errorf("snapshot of a missing release was written: %v", err)
+	}
+}
+
+func TestActionSpecApplyDebug(t *testing.T) {
+	tests := []struct {
+		name         string
+		debug        bool
+		debugActions []string
+		want         bool
+	}{
+		{"global off", false, nil, false},
+		{"global on", true, nil, true},
+		{"listed", false, []string{lintPkg, deployPkg}, true},
+		{"not listed", true, []string{lintPkg}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPlugin()
+			p.Debug = tt.debug
+			p.DebugActions = tt.debugActions
+			if got := (actionSpec{name: deployPkg}).apply(p).Debug; got != tt.want {
+				t.Errorf("apply() debug = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecDebugActions(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Actions = []string{lintPkg, createPkg}
+	p.DebugActions = []string{createPkg}
+	var err error
+	lines := captureLog(func() { err = p.Exec() })
+	if err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	logged := strings.Join(lines, "\n")
+	if !strings.Contains(logged, "running: helm package --version 1.0.0 chart") {
+		t.Errorf("commands of the debug action were not logged: %q", lines)
+	}
+	if strings.Contains(logged, "helm lint") {
+		t.Errorf("commands of the other action were logged: %q", lines)
+	}
+}
+
+func TestNotReadyPods(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []string
+	}{
+		{"no pods", "", nil},
+		{"ready", "app-1=Running/True\napp-2=Running/True\n", nil},
+		{"completed", "migrate=Succeeded/False\n", nil},
+		{"not ready", "app-1=Running/True\napp-2=Running/False\n", []string{"app-2"}},
+		{"pending", "app-1=Pending/\napp-2=Failed/False", []string{"app-1", "app-2"}},
+		{"malformed", "app-1\napp-2=Pending/False", []string{"app-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notReadyPods(tt.out); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("notReadyPods() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployWaitFailureDiagnostics(t *testing.T) {
+	tests := []struct {
+		name      string
+		upgrade   string
+		wantDumps bool
+	}{
+		{"timeout", "echo 'Error: UPGRADE FAILED: timed out waiting for the condition' >&2; exit 1", true},
+		{"other failure", "echo 'Error: UPGRADE FAILED: invalid manifest' >&2; exit 1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm": fmt.Sprintf(`[ "$1" = upgrade ] || exit 0
+%s`, tt.upgrade),
+				"kubectl": `case "$1 $2" in
+"get pods") echo 'app-1=Running/True'; echo 'app-2=Pending/False' ;;
+"get namespace") echo default ;;
+esac`,
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Namespace = "apps"
+			p.Wait = true
+			p.WaitFailureDiagnostics = true
+			if err := p.deployPackage(); err == nil {
+				t.Fatal("deployPackage() succeeded")
+			}
+
+			got := calls()
+			for _, c := range []string{
+				"kubectl get events --namespace apps --sort-by=.lastTimestamp",
+				"kubectl describe pod app-2 --namespace apps",
+			} {
+				if hasCall(got, c) != tt.wantDumps {
+					t.Errorf("%q run is %v, want %v: %q", c, !tt.wantDumps, tt.wantDumps, got)
+				}
+			}
+			if hasCall(got, "kubectl describe pod app-1") {
+				t.Errorf("ready pod was described: %q", got)
+			}
+		})
+	}
+}
+
+func TestDeployForceConflicts(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		t.Run(fmt.Sprint(force), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"helm":    `[ "$1" = version ] && echo '{"client":{"version":"v4.0.0"}}'; exit 0`,
+				"kubectl": "echo exists",
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.ServerSideApply = true
+			p.ForceConflicts = force
+			var err error
+			lines := captureLog(func() { err = p.deployPackage() })
+			if err != nil {
+				t.Fatalf("deployPackage() error = %v", err)
+			}
+			want := "helm upgrade app app-1.0.0.tgz --server-side --install"
+			if force {
+				want = "helm upgrade app app-1.0.0.tgz --server-side --force-conflicts --install"
+			}
+			if !hasCall(calls(), want) {
+				t.Errorf("%q was not run: %q", want, calls())
+			}
+			if warned := strings.Contains(strings.Join(lines, "\n"), "warning: force conflicts"); warned != force {
+				t.Errorf("deployPackage() logged %q, want warning %v", lines, force)
+			}
+		})
+	}
+
+	p := newTestPlugin()
+	p.ForceConflicts = true
+	if err := p.validate(); err == nil {
+		t.Error("validate() accepted force conflicts without server side apply")
+	}
+}
+
+func TestValidateManifestsForceConflicts(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    "echo 'kind: Deployment'",
+		"kubectl": "exit 0",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.ServerSideApply = true
+	p.ForceConflicts = true
+	if err := p.validateManifests("app-1.0.0.tgz", nil); err != nil {
+		t.Fatalf("validateManifests() error = %v", err)
+	}
+	if want := "kubectl apply --dry-run=server --validate=true --namespace default -f - --server-side --force-conflicts"; !hasCall(calls(), want) {
+		t.Errorf("%q was not run: %q", want, calls())
+	}
+}
+
+func TestSetupProjectCredentialRetries(t *testing.T) {
+	defer func(d time.Duration) { credentialRetryWait = d }(credentialRetryWait)
+	credentialRetryWait = time.Millisecond
+
+	tests := []struct {
+		name      string
+		failures  int
+		stderr    string
+		retries   int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", 0, "", 3, 1, false},
+		{"retry then success", 2, "ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=503", 3, 3, false},
+		{"retries exhausted", 5, "ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=503", 2, 3, true},
+		{"auth error", 5, "ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=403, Forbidden", 3, 1, true},
+		{"missing permission", 5, `ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=403, message=Required "container.clusters.get" permission(s) for "projects/project/zones/europe-west1-b/clusters/prod".`, 3, 1, true},
+		{"no retries", 5, "ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=503", 0, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{
+				"gcloud": fmt.Sprintf(`[ "$2" = clusters ] || exit 0
+n=$(grep -c get-credentials "$FAKE_DIR/calls")
+if [ "$n" -le %d ]; then echo '%s' >&2; exit 1; fi`, tt.failures, tt.stderr),
+			})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Project = "project"
+			p.Cluster = "prod"
+			p.Zone = "europe-west1-b"
+			p.CredentialRetries = tt.retries
+			if err := p.setupProject(); (err != nil) != tt.wantErr {
+				t.Fatalf("setupProject() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			n := 0
+			for _, c := range calls() {
+				if strings.HasPrefix(c, "gcloud container clusters get-credentials prod") {
+					n++
+				}
+			}
+			if n != tt.wantCalls {
+				t.Errorf("get-credentials ran %d times, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestGcloudQuiet(t *testing.T) {
+	for _, quiet := range []bool{true, false} {
+		t.Run(fmt.Sprintf("quiet=%v", quiet), func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+			defer restore()
+			defer os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+
+			p := newTestPlugin()
+			p.Project = "project"
+			p.Cluster = "prod"
+			p.Zone = "europe-west1-b"
+			p.KeyPath = "/tmp/key.json"
+			p.GcloudQuiet = quiet
+			if err := p.setupAuth(); err != nil {
+				t.Fatalf("setupAuth() error = %v", err)
+			}
+			if err := p.setupProject(); err != nil {
+				t.Fatalf("setupProject() error = %v", err)
+			}
+
+			got := calls()
+			if len(got) != 3 {
+				t.Fatalf("ran %q, want auth, project and credentials", got)
+			}
+			for _, c := range got {
+				if strings.HasPrefix(c, "gcloud --quiet ") != quiet {
+					t.Errorf("--quiet in %q is %v, want %v", c, !quiet, quiet)
+				}
+			}
+		})
+	}
+}
+
+// captureStdout returns what f writes to the standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	b, _ := ioutil.ReadAll(r)
+	return string(b)
+}
+
+func TestRunLogFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		debug   bool
+		wantLog string
+	}{
+		{"without debug", false, "deployed\nrunning: /bin/sh -c echo deployed; echo warning >&2\nwarning"},
+		{"with debug", true, "deployed\nwarning"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logFile bytes.Buffer
+			p := newTestPlugin()
+			p.Debug = tt.debug
+			p.logWriter = &lockedWriter{w: &logFile}
+
+			var err error
+			captureLog(func() {
+				stdout := captureStdout(t, func() {
+					err = p.run(exec.Command("/bin/sh", "-c", "echo deployed; echo warning >&2"))
+				})
+				if stdout != "deployed\n" {
+					t.Errorf("run() printed %q to stdout, want the output of the command", stdout)
+				}
+			})
+			if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			// standard output and error are copied concurrently
+			lines := strings.Split(strings.TrimSpace(logFile.String()), "\n")
+			sort.Strings(lines)
+			if got := strings.Join(lines, "\n"); got != tt.wantLog {
+				t.Errorf("sorted log file = %q, want %q", got, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestValidateKubeVersion(t *testing.T) {
+	tests := []struct {
+		kubeVersion string
+		wantErr     bool
+	}{
+		{"", false},
+		{"v1.27", false},
+		{"1.27.3", false},
+		{"v1", true},
+		{"1.27.3-gke.100", true},
+		{"latest", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kubeVersion, func(t *testing.T) {
+			p := newTestPlugin()
+			p.KubeVersion = tt.kubeVersion
+			if err := p.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLintKubeVersion(t *testing.T) {
+	for _, kubeVersion := range []string{"", "v1.27"} {
+		t.Run(kubeVersion, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.KubeVersion = kubeVersion
+			p.RenderCheck = true
+			if err := p.lintPackage(); err != nil {
+				t.Fatalf("lintPackage() error = %v", err)
+			}
+
+			got := calls()
+			if len(got) != 2 {
+				t.Fatalf("lintPackage() ran %q, want lint and template", got)
+			}
+			for _, c := range got {
+				if strings.Contains(c, " --kube-version v1.27") != (kubeVersion != "") {
+					t.Errorf("--kube-version in %q, want it with kube version %q", c, kubeVersion)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderManifestsAPIVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		apiVersions []string
+		want        string
+	}{
+		{"none", nil, "helm template app chart --namespace default"},
+		{"one", []string{"monitoring.coreos.com/v1"}, "helm template app chart --api-versions monitoring.coreos.com/v1 --namespace default"},
+		{"multiple", []string{"monitoring.coreos.com/v1", "monitoring.coreos.com/v1/ServiceMonitor"}, "helm template app chart --api-versions monitoring.coreos.com/v1 --api-versions monitoring.coreos.com/v1/ServiceMonitor --namespace default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"helm": "echo 'kind: ServiceMonitor'"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.APIVersions = tt.apiVersions
+			out, err := p.renderManifests("chart", nil)
+			if err != nil {
+				t.Fatalf("renderManifests() error = %v", err)
+			}
+			if string(out) != "kind: ServiceMonitor\n" {
+				t.Errorf("renderManifests() = %q, want the rendered manifests", out)
+			}
+			if got := calls(); got[0] != tt.want {
+				t.Errorf("renderManifests() ran %q, want %q", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestLintAPIVersions(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+	defer restore()
+
+	p := newTestPlugin()
+	p.APIVersions = []string{"monitoring.coreos.com/v1"}
+	p.RenderCheck = true
+	if err := p.lintPackage(); err != nil {
+		t.Fatalf("lintPackage() error = %v", err)
+	}
+	got := calls()
+	if len(got) != 2 || strings.Contains(got[0], "--api-versions") || !strings.Contains(got[1], " --api-versions monitoring.coreos.com/v1 ") {
+		t.Errorf("lintPackage() ran %q, want --api-versions only for helm template", got)
+	}
+}
+
+func TestLintFindings(t *testing.T) {
+	tests := []struct {
+		name         string
+		out          string
+		wantWarnings []string
+		wantErrs     []string
+	}{
+		{"clean", "==> Linting chart\n1 chart(s) linted, 0 chart(s) failed\n", nil, nil},
+		{"info only", "==> Linting chart\n[INFO] Chart.yaml: icon is recommended\n", nil, nil},
+		{"warnings only", "==> Linting chart\n[INFO] Chart.yaml: icon is recommended\n[WARNING] templates/: deprecated API\n  [WARNING] values.yaml: unused value\n", []string{"[WARNING] templates/: deprecated API", "[WARNING] values.yaml: unused value"}, nil},
+		{"errors and warnings", "[WARNING] templates/: deprecated API\n[ERROR] templates/: parse error\n\nError: 1 chart(s) linted, 1 chart(s) failed\n", []string{"[WARNING] templates/: deprecated API"}, []string{"[ERROR] templates/: parse error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, errs := lintFindings(tt.out)
+			if strings.Join(warnings, "\n") != strings.Join(tt.wantWarnings, "\n") {
+				t.Errorf("lintFindings() warnings = %q, want %q", warnings, tt.wantWarnings)
+			}
+			if strings.Join(errs, "\n") != strings.Join(tt.wantErrs, "\n") {
+				t.Errorf("lintFindings() errors = %q, want %q", errs, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestLintWarnings(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		helm        string
+		wantErr     string
+		wantWarning bool
+		wantLog     bool
+	}{
+		{"clean", false, "echo '1 chart(s) linted, 0 chart(s) failed'", "", false, false},
+		{"warnings", false, "echo '[WARNING] templates/: deprecated API'", "lint of chart chart found 1 warnings", true, true},
+		{"warnings strict", true, "echo '[WARNING] templates/: deprecated API'", "lint of chart chart found 1 warnings", false, true},
+		{"errors strict", true, "echo '[ERROR] templates/: parse error'; exit 1", "lint of chart chart failed with exit code 1: [ERROR] templates/: parse error", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restore := fakeCommands(t, map[string]string{"helm": tt.helm})
+			defer restore()
+
+			p := newTestPlugin()
+			p.LintStrict = tt.strict
+			var err error
+			lines := captureLog(func() { err = p.lintPackage() })
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("lintPackage() error = %v, want %q", err, tt.wantErr)
+			}
+			if isWarning(err) != tt.wantWarning {
+				t.Errorf("lintPackage() error %v is a warning %v, want %v", err, isWarning(err), tt.wantWarning)
+			}
+			logged := strings.HasPrefix(lines[0], "warning: lint of chart chart found 1 warnings:")
+			if logged != tt.wantLog {
+				t.Errorf("lintPackage() logged %q, want the warnings logged %v", lines, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestExecLintWarnings(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{"helm": "echo '[WARNING] templates/: deprecated API'"})
+	defer restore()
+
+	// warnings do not stop the run, but are reported apart from a clean lint
+	p := newTestPlugin()
+	p.Actions = []string{lintPkg, lintPkg + ":namespace=other"}
+	var err error
+	var out string
+	captureLog(func() { out = captureStdout(t, func() { err = p.Exec() }) })
+	if err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Exec() printed %q, want a result of both lint actions", lines)
+	}
+	for _, l := range lines[1:] {
+		if f := strings.Fields(l); len(f) < 3 || f[2] != "warning" {
+			t.Errorf("result %q has no warning status", l)
+		}
+	}
+}
+
+func TestSetupProjectDNSEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		dnsEndpoint bool
+		want        string
+	}{
+		{"ip endpoint", false, "gcloud container clusters get-credentials prod --location europe-west1"},
+		{"dns endpoint", true, "gcloud container clusters get-credentials prod --location europe-west1 --dns-endpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Project = "project"
+			p.Cluster = "prod"
+			p.Location = "europe-west1"
+			p.DNSEndpoint = tt.dnsEndpoint
+			if err := p.setupProject(); err != nil {
+				t.Fatalf("setupProject() error = %v", err)
+			}
+			if got := calls(); got[len(got)-1] != tt.want {
+				t.Errorf("setupProject() ran %q, want %q", got[len(got)-1], tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateDNSEndpoint(t *testing.T) {
+	p := newTestPlugin()
+	p.DNSEndpoint = true
+	if err := p.validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	p.UseConnectGateway = true
+	p.MembershipName = "prod-membership"
+	if err := p.validate(); err == nil || err.Error() != "dns endpoint can not be used with the connect gateway" {
+		t.Errorf("validate() error = %v, want the conflict with the connect gateway", err)
+	}
+}
+
+func TestParseK8sValue(t *testing.T) {
+	tests := []struct {
+		entry                 string
+		key, kind, name, path string
+		wantErr               bool
+	}{
+		{"token=secret/api/.data.token", "token", "secret", "api", ".data.token", false},
+		{"db.host=ConfigMap/db/.data.host", "db.host", "configmap", "db", ".data.host", false},
+		{"ip=service/app/.status.loadBalancer.ingress[0].ip", "ip", "service", "app", ".status.loadBalancer.ingress[0].ip", false},
+		{"url=configmap/app/.data.url=https", "url", "configmap", "app", ".data.url=https", false},
+		{"token", "", "", "", "", true},
+		{"=secret/api/.data.token", "", "", "", "", true},
+		{"token=secret/api", "", "", "", "", true},
+		{"token=secret//.data.token", "", "", "", "", true},
+		{"token=secret/api/data.token", "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			key, kind, name, path, err := parseK8sValue(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseK8sValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if key != tt.key || kind != tt.kind || name != tt.name || path != tt.path {
+				t.Errorf("parseK8sValue() = %q, %q, %q, %q, want %q, %q, %q, %q", key, kind, name, path, tt.key, tt.kind, tt.name, tt.path)
+			}
+		})
+	}
+}
+
+func TestLookupK8sValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		entry    string
+		out      string
+		want     string
+		wantCall string
+	}{
+		{"secret", "token=secret/api/.data.token", base64.StdEncoding.EncodeToString([]byte("to,ken")), `'token=to\,ken'`, "kubectl get secret api --namespace default --output jsonpath={.data.token}"},
+		{"secret with quote", "token=secret/api/.data.token", base64.StdEncoding.EncodeToString([]byte("it's-t0ken")), `'token=it'\''s-t0ken'`, "kubectl get secret api --namespace default --output jsonpath={.data.token}"},
+		{"config map", "db.host=configmap/db/.data.host", "db.internal", "'db.host=db.internal'", "kubectl get configmap db --namespace default --output jsonpath={.data.host}"},
+		{"secret metadata", "uid=secret/api/.metadata.uid", "1234", "'uid=1234'", "kubectl get secret api --namespace default --output jsonpath={.metadata.uid}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetMasked()()
+			calls, restore := fakeCommands(t, map[string]string{"kubectl": fmt.Sprintf("printf '%%s' '%s'", tt.out)})
+			defer restore()
+
+			p := newTestPlugin()
+			got, err := p.lookupK8sValue(tt.entry)
+			if err != nil {
+				t.Fatalf("lookupK8sValue() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("lookupK8sValue() = %q, want %q", got, tt.want)
+			}
+			if c := calls(); c[0] != tt.wantCall {
+				t.Errorf("lookupK8sValue() ran %q, want %q", c[0], tt.wantCall)
+			}
+			value := strings.TrimSuffix(strings.SplitN(got, "=", 2)[1], "'")
+			if s := sanitize("--set-string " + got); strings.Contains(s, value) {
+				t.Errorf("value %q is not masked in %q", value, s)
+			}
+		})
+	}
+}
+
+func TestLookupK8sValueErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		kubectl string
+		wantErr string
+	}{
+		{"not found", `echo 'Error from server (NotFound): secrets "api" not found' >&2; exit 1`, "could not look up value for key 'token': "},
+		{"invalid base64", `printf 'not base64!'`, "could not decode secret value for key 'token': "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restore := fakeCommands(t, map[string]string{"kubectl": tt.kubectl})
+			defer restore()
+
+			p := newTestPlugin()
+			if _, err := p.lookupK8sValue("token=secret/api/.data.token"); err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("lookupK8sValue() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeployValuesFromK8sMasked(t *testing.T) {
+	defer resetMasked()()
+	_, restore := fakeCommands(t, map[string]string{
+		"helm": "exit 0",
+		"kubectl": fmt.Sprintf(`case "$1" in
+get) printf '%s' ;;
+*) echo 'deployment "app" successfully rolled out' ;;
+esac`, base64.StdEncoding.EncodeToString([]byte("t0ken"))),
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Debug = true
+	p.ValuesFromK8s = []string{"api.token=secret/api/.data.token"}
+	var err error
+	lines := captureLog(func() { err = p.deployPackage() })
+	if err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+
+	logged := false
+	for _, l := range lines {
+		if strings.Contains(l, "t0ken") {
+			t.Errorf("value from k8s is logged: %q", l)
+		}
+		if strings.HasPrefix(l, "running: /bin/sh -c helm upgrade") && strings.Contains(l, "--set-string 'api.token=****'") {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("helm upgrade with the masked value was not logged: %q", lines)
+	}
+}
+
+func TestSetupProjectComputeDefaults(t *testing.T) {
+	tests := []struct {
+		name          string
+		region, zone  string
+		wantConfigSet []string
+	}{
+		{"none", "", "", []string{"gcloud config set project project"}},
+		{"region", "europe-west1", "", []string{"gcloud config set project project", "gcloud config set compute/region europe-west1"}},
+		{"zone", "", "europe-west1-b", []string{"gcloud config set project project", "gcloud config set compute/zone europe-west1-b"}},
+		{"region and zone", "europe-west1", "europe-west1-b", []string{"gcloud config set project project", "gcloud config set compute/region europe-west1", "gcloud config set compute/zone europe-west1-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, restore := fakeCommands(t, map[string]string{"gcloud": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Project = "project"
+			p.Cluster = "prod"
+			p.Zone = "europe-west1-b"
+			p.ComputeRegion = tt.region
+			p.ComputeZone = tt.zone
+			if err := p.setupProject(); err != nil {
+				t.Fatalf("setupProject() error = %v", err)
+			}
+
+			got := calls()
+			if strings.Join(got[:len(got)-1], "\n") != strings.Join(tt.wantConfigSet, "\n") {
+				t.Errorf("setupProject() ran %q, want %q before the credentials", got, tt.wantConfigSet)
+			}
+			if !strings.HasPrefix(got[len(got)-1], "gcloud container clusters get-credentials prod") {
+				t.Errorf("setupProject() ran %q last, want the credentials", got[len(got)-1])
+			}
+		})
+	}
+}
+
+func TestSetupProjectComputeDefaultsFailure(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{"gcloud": `[ "$3" = compute/zone ] && exit 1; exit 0`})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Project = "project"
+	p.ComputeZone = "europe-west1-x"
+	if err := p.setupProject(); err == nil || !strings.HasPrefix(err.Error(), "could not configure compute/zone with gcloud") {
+		t.Errorf("setupProject() error = %v, want the failure of compute/zone", err)
+	}
+}
+
+func TestOutputHelmDebugErrors(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{"helm": "echo 'Error: release: not found' >&2; exit 1"})
+	defer restore()
+
+	for _, helmDebug := range []bool{false, true} {
+		p := newTestPlugin()
+		p.HelmDebug = helmDebug
+		_, err := p.releaseRevision()
+		if !errors.Is(err, ErrReleaseNotFound) {
+			t.Errorf("releaseRevision() with helm debug %v error = %v, want ErrReleaseNotFound", helmDebug, err)
+		}
+		if got := exitErrorOutput(err); got != "Error: release: not found\n" {
+			t.Errorf("exitErrorOutput() with helm debug %v = %q, want the standard error", helmDebug, got)
+		}
+	}
+}
+
+func TestOutputLogFile(t *testing.T) {
+	var logFile bytes.Buffer
+	p := newTestPlugin()
+	p.logWriter = &lockedWriter{w: &logFile}
+
+	out, err := p.output(exec.Command("/bin/sh", "-c", "echo status; echo warning >&2; exit 3"))
+	if string(out) != "status\n" {
+		t.Errorf("output() = %q, want the standard output", out)
+	}
+	if got := exitErrorOutput(err); got != "warning\n" {
+		t.Errorf("output() standard error = %q, want it captured also with a log file", got)
+	}
+	lines := strings.Split(strings.TrimSpace(logFile.String()), "\n")
+	sort.Strings(lines)
+	if got, want := strings.Join(lines, "\n"), "running: /bin/sh -c echo status; echo warning >&2; exit 3\nstatus\nwarning"; got != want {
+		t.Errorf("sorted log file = %q, want %q", got, want)
+	}
+}
+
+func TestRunLogFileConcurrent(t *testing.T) {
+	var logFile bytes.Buffer
+	p := newTestPlugin()
+	p.logWriter = &lockedWriter{w: &logFile}
+
+	// the parallel namespace deploys share the log file
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd := exec.Command("/bin/sh", "-c", "echo out; echo err >&2")
+			cmd.Stdout = ioutil.Discard
+			cmd.Stderr = ioutil.Discard
+			if err := p.run(cmd); err != nil {
+				t.Errorf("run() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := strings.Count(logFile.String(), "\n"); got != 12 {
+		t.Errorf("log file has %d lines, want the command line and output of all commands:\n%s", got, logFile.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// registryUser is the user name of logins with a gcloud access token
+const registryUser = "oauth2accesstoken"
+
+// artifactRegistryHost returns the host of an oci:// reference to an
+// Artifact Registry repository, other references have no host.
+func artifactRegistryHost(ref string) string {
+	if !strings.HasPrefix(ref, "oci://") {
+		return ""
+	}
+	host := strings.SplitN(strings.TrimPrefix(ref, "oci://"), "/", 2)[0]
+	if !strings.HasSuffix(host, ".pkg.dev") {
+		return ""
+	}
+	return host
+}
+
+// registryLogin logs helm in to the Artifact Registry hosts of the refs with
+// the access token of the gcloud account. The token is masked in the logs.
+// gcloud auth print-access-token | helm registry login $HOST -u oauth2accesstoken --password-stdin
+func (p Plugin) registryLogin(refs ...string) error {
+	var hosts []string
+	for _, r := range refs {
+		if h := artifactRegistryHost(r); h != "" && !contains(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil
+	}
+
+	out, err := p.output(p.gcloudCommand("auth", "print-access-token"))
+	if err != nil {
+		return fmt.Errorf("could not get access token for the registry: %w", err)
+	}
+	token := strings.TrimSpace(string(out))
+	mask(token)
+	for _, h := range hosts {
+		cmd := exec.Command(helmBin, "registry", "login", h, "-u", registryUser, "--password-stdin")
+		cmd.Stdin = strings.NewReader(token)
+		if err := p.run(cmd); err != nil {
+			return fmt.Errorf("could not log in to registry %s: %w", h, err)
+		}
+		if p.registryLogins != nil {
+			p.registryLogins.add(h)
+		}
+	}
+	return nil
+}
+
+// registryHosts are the registries helm logged in to, it is safe for
+// concurrent use
+type registryHosts struct {
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (r *registryHosts) add(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !contains(r.hosts, host) {
+		r.hosts = append(r.hosts, host)
+	}
+}
+
+// registryLogout logs helm out of all registries it logged in to, so the
+// credentials do not stay in the helm registry config. Failures are only
+// logged.
+// helm registry logout $HOST
+func (p Plugin) registryLogout() {
+	if p.registryLogins == nil {
+		return
+	}
+	p.registryLogins.mu.Lock()
+	defer p.registryLogins.mu.Unlock()
+	for _, h := range p.registryLogins.hosts {
+		if err := p.run(exec.Command(helmBin, "registry", "logout", h)); err != nil {
+			log.Printf("could not log out of registry %s: %v", h, err)
+		}
+	}
+	p.registryLogins.hosts = nil
+}
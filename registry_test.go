@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArtifactRegistryHost(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"oci://europe-docker.pkg.dev/project/charts/app", "europe-docker.pkg.dev"},
+		{"oci://europe-docker.pkg.dev/project/charts", "europe-docker.pkg.dev"},
+		{"oci://registry.example.com/charts/app", ""},
+		{"https://europe-docker.pkg.dev/project/charts", ""},
+		{"stable/nginx", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			if got := artifactRegistryHost(tt.ref); got != tt.want {
+				t.Errorf("artifactRegistryHost() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// registryFakes are fake commands for the registry login, helm records the
+// password it reads from stdin
+var registryFakes = map[string]string{
+	"gcloud": "echo ya29.t0ken",
+	"helm":   `[ "$2" = login ] && { cat; echo; } | sed 's/^/password: /' >> "$FAKE_DIR/calls"; exit 0`,
+}
+
+func TestRegistryLogin(t *testing.T) {
+	defer resetMasked()()
+	calls, restore := fakeCommands(t, registryFakes)
+	defer restore()
+
+	p := newTestPlugin()
+	p.Debug = true
+	var err error
+	lines := captureLog(func() {
+		err = p.registryLogin(
+			"oci://europe-docker.pkg.dev/project/charts/app",
+			"oci://europe-docker.pkg.dev/project/other",
+			"oci://us-docker.pkg.dev/project/charts",
+			"https://charts.example.com",
+		)
+	})
+	if err != nil {
+		t.Fatalf("registryLogin() error = %v", err)
+	}
+
+	want := []string{
+		"gcloud auth print-access-token",
+		"helm registry login europe-docker.pkg.dev -u oauth2accesstoken --password-stdin",
+		"password: ya29.t0ken",
+		"helm registry login us-docker.pkg.dev -u oauth2accesstoken --password-stdin",
+		"password: ya29.t0ken",
+	}
+	if got := calls(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("registryLogin() ran %q, want %q", got, want)
+	}
+	if s := sanitize("token ya29.t0ken"); s != "token ****" {
+		t.Errorf("sanitize() = %q, want the token masked", s)
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "ya29.t0ken") {
+			t.Errorf("token is logged: %q", l)
+		}
+	}
+}
+
+func TestRegistryLoginOtherRegistries(t *testing.T) {
+	calls, restore := fakeCommands(t, registryFakes)
+	defer restore()
+
+	p := newTestPlugin()
+	if err := p.registryLogin("oci://registry.example.com/charts/app", "stable/nginx"); err != nil {
+		t.Fatalf("registryLogin() error = %v", err)
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("registryLogin() ran %q without Artifact Registry refs", got)
+	}
+}
+
+func TestRegistryLoginTokenFailure(t *testing.T) {
+	_, restore := fakeCommands(t, map[string]string{"gcloud": "echo 'ERROR: (gcloud.auth.print-access-token) You do not currently have an active account selected.' >&2; exit 1"})
+	defer restore()
+
+	p := newTestPlugin()
+	err := p.registryLogin("oci://europe-docker.pkg.dev/project/charts/app")
+	if err == nil || !strings.HasPrefix(err.Error(), "could not get access token for the registry") {
+		t.Errorf("registryLogin() error = %v, want the token failure", err)
+	}
+}
+
+func TestExecRegistryLogin(t *testing.T) {
+	dir, remove := writeTestChart(t, testChartFile)
+	defer remove()
+
+	tests := []struct {
+		name   string
+		action string
+		ref    string
+		want   string
+	}{
+		{"show", showPkg, "oci://europe-docker.pkg.dev/project/charts/app", "helm show values oci://europe-docker.pkg.dev/project/charts/app --version 1.0.0"},
+		{"dep", dependencyPkg, "", "helm dependency update " + dir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetMasked()()
+			calls, restore := fakeCommands(t, registryFakes)
+			defer restore()
+
+			p := newTestPlugin()
+			p.ChartPath = dir
+			p.ChartRef = tt.ref
+			if err := p.execAction(tt.action); err != nil {
+				t.Fatalf("execAction() error = %v", err)
+			}
+
+			// the login comes before the registry is used
+			got := calls()
+			login, used := -1, -1
+			for i, c := range got {
+				switch {
+				case c == "helm registry login europe-docker.pkg.dev -u oauth2accesstoken --password-stdin":
+					login = i
+				case strings.HasPrefix(c, tt.want):
+					used = i
+				}
+			}
+			if login < 0 || used < login {
+				t.Errorf("execAction() ran %q, want the login before %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecRegistryLogout(t *testing.T) {
+	tests := []struct {
+		name    string
+		helm    string
+		wantErr bool
+	}{
+		{"success", registryFakes["helm"], false},
+		{"failure", `[ "$2" = login ] && { cat; echo; } | sed 's/^/password: /' >> "$FAKE_DIR/calls" && exit 0; exit 1`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetMasked()()
+			calls, restore := fakeCommands(t, map[string]string{"gcloud": registryFakes["gcloud"], "helm": tt.helm})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Actions = []string{showPkg}
+			p.ChartRef = "oci://europe-docker.pkg.dev/project/charts/app"
+			p.RegistryLogout = true
+			if err := p.Exec(); (err != nil) != tt.wantErr {
+				t.Fatalf("Exec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got := calls()
+			if len(got) == 0 || got[len(got)-1] != "helm registry logout europe-docker.pkg.dev" {
+				t.Errorf("Exec() ran %q, want the logout at the end", got)
+			}
+		})
+	}
+}
+
+func TestExecRegistryLogoutDisabled(t *testing.T) {
+	defer resetMasked()()
+	calls, restore := fakeCommands(t, registryFakes)
+	defer restore()
+
+	p := newTestPlugin()
+	p.Actions = []string{showPkg}
+	p.ChartRef = "oci://europe-docker.pkg.dev/project/charts/app"
+	if err := p.Exec(); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+	for _, c := range calls() {
+		if strings.HasPrefix(c, "helm registry logout") {
+			t.Errorf("Exec() ran %q with registry_logout disabled", c)
+		}
+	}
+}
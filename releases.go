@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// releaseSpec is a release deployed in the multi release mode
+type releaseSpec struct {
+	ChartPath    string   `json:"chart_path"`
+	ChartVersion string   `json:"chart_version"`
+	Package      string   `json:"package"`
+	Release      string   `json:"release"`
+	Namespace    string   `json:"namespace"`
+	Values       []string `json:"values"`
+	ValueFiles   []string `json:"value_files"`
+}
+
+// releaseList is a list of releases. Drone passes lists of objects as JSON.
+type releaseList []releaseSpec
+
+// Decode implements envconfig.Decoder
+func (l *releaseList) Decode(value string) error {
+	return json.Unmarshal([]byte(value), l)
+}
+
+// apply returns a copy of the plugin deploying the release. Unset fields
+// are defaulted like for a single release, the namespace falls back to the
+// namespace of the plugin. The chart sources and secrets of the plugin
+// belong to the single release and are not used.
+func (r releaseSpec) apply(p Plugin) Plugin {
+	p.Releases = nil
+	p.ChartGlob = ""
+	p.ChartURL = ""
+	p.GitRepo = ""
+	p.GitRef = ""
+	p.Secrets = nil
+	p.SecretManagerSecrets = nil
+	p.ValuesFromK8s = nil
+	p.ChartPath = r.ChartPath
+	p.ChartVersion = r.ChartVersion
+	p.Package = r.Package
+	p.Release = r.Release
+	p.Values = r.Values
+	p.ValueFiles = r.ValueFiles
+	if r.Namespace != "" {
+		p.Namespace = r.Namespace
+	}
+	setChartDefaults(&p)
+	return p
+}
+
+// deployReleases deploys all releases in order and stops at the first failure
+func (p Plugin) deployReleases() error {
+	for _, r := range p.Releases {
+		rp := r.apply(p)
+		if err := rp.deployPackage(); err != nil {
+			return fmt.Errorf("could not deploy release %s: %w", rp.Release, err)
+		}
+	}
+	return nil
+}
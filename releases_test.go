@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReleaseSpecApply(t *testing.T) {
+	p := newTestPlugin()
+	p.Namespace = "apps"
+	p.Values = []string{"a=1"}
+	p.ChartURL = "https://charts.example.com/app.tgz"
+	p.ChartGlob = "*.tgz"
+	p.GitRepo = "https://git.example.com/charts.git"
+	p.Secrets = []string{"secrets.yaml"}
+	p.SecretManagerSecrets = []string{"password=projects/p/secrets/db/versions/1"}
+	p.ValuesFromK8s = []string{"token=secret/app/.data.token"}
+	p.Releases = releaseList{{ChartPath: "charts/db"}}
+
+	rp := releaseSpec{ChartPath: "charts/db", Values: []string{"b=2"}}.apply(p)
+	if rp.Package != "db" || rp.Release != "db" || rp.Namespace != "apps" {
+		t.Errorf("apply() = %q, %q, %q, want the defaults db, db, apps", rp.Package, rp.Release, rp.Namespace)
+	}
+	if strings.Join(rp.Values, ",") != "b=2" {
+		t.Errorf("apply() values = %q, want the values of the release", rp.Values)
+	}
+	if rp.ChartURL != "" || rp.ChartGlob != "" || rp.GitRepo != "" {
+		t.Errorf("apply() kept the chart source %q, %q, %q", rp.ChartURL, rp.ChartGlob, rp.GitRepo)
+	}
+	if len(rp.Secrets) != 0 || len(rp.SecretManagerSecrets) != 0 || len(rp.ValuesFromK8s) != 0 {
+		t.Errorf("apply() kept the secrets of the plugin")
+	}
+	if len(rp.Releases) != 0 {
+		t.Errorf("apply() kept the releases")
+	}
+
+	rp = releaseSpec{ChartPath: "charts/db", Release: "db-eu", Namespace: "eu"}.apply(p)
+	if rp.Release != "db-eu" || rp.Namespace != "eu" {
+		t.Errorf("apply() = %q, %q, want db-eu, eu", rp.Release, rp.Namespace)
+	}
+}
+
+func TestValidateReleases(t *testing.T) {
+	var l releaseList
+	if err := l.Decode(`[{"chart_path":"charts/web"},{"release":"db"}]`); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	p := newTestPlugin()
+	p.Releases = l
+	if err := p.validate(); err == nil || !strings.Contains(err.Error(), "release 2") {
+		t.Errorf("validate() error = %v, want release 2 without chart path", err)
+	}
+}
+
+func TestDeployReleases(t *testing.T) {
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm":    `[ "$1 $2" = "upgrade db" ] && exit 1; exit 0`,
+		"kubectl": "echo exists",
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Releases = releaseList{
+		{ChartPath: "charts/web", ChartVersion: "1.0.0"},
+		{ChartPath: "charts/db", ChartVersion: "2.0.0", Namespace: "data"},
+		{ChartPath: "charts/cache", ChartVersion: "3.0.0"},
+	}
+	err := p.deployPackage()
+	if err == nil || !strings.Contains(err.Error(), "release db") {
+		t.Fatalf("deployPackage() error = %v, want the failed release", err)
+	}
+
+	got := calls()
+	for _, want := range []string{
+		"helm upgrade web web-1.0.0.tgz --install --namespace default",
+		"helm upgrade db db-2.0.0.tgz --install --namespace data",
+	} {
+		if !hasCall(got, want) {
+			t.Errorf("%q was not run: %q", want, got)
+		}
+	}
+	// the deploy stops at the first failure
+	if hasCall(got, "helm upgrade cache") {
+		t.Errorf("release after the failure was deployed: %q", got)
+	}
+}
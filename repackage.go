@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// repackage compresses the chart archive again with the gzip level. The
+// content of the archive is not changed.
+func repackage(file string, level int) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", file, err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw, err := gzip.NewWriterLevel(tmp, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, zr); err != nil {
+		return fmt.Errorf("could not compress %s: %w", file, err)
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// keep the permissions of helm package instead of the private temp file ones
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode()); err != nil {
+		return err
+	}
+
+	if err := verifyArchive(tmp.Name()); err != nil {
+		return fmt.Errorf("repackaged archive is invalid: %w", err)
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// verifyArchive reads all entries of the tgz archive
+func verifyArchive(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return err
+		}
+	}
+}
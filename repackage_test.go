@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testChartFiles are the files of the test chart archive
+var testChartFiles = map[string]string{
+	"app/Chart.yaml":  testChartFile,
+	"app/values.yaml": strings.Repeat("# the replicas of the deployment\nreplicas: 2\n", 200),
+}
+
+// writeTestArchive writes the test chart files as tgz with the gzip level
+func writeTestArchive(t *testing.T, file string, level int) {
+	t.Helper()
+	var b bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&b, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, name := range []string{"app/Chart.yaml", "app/values.yaml"} {
+		content := testChartFiles[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readArchive returns the files of the tgz archive
+func readArchive(t *testing.T, file string) map[string]string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s is not gzip compressed: %v", file, err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			break
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[h.Name] = string(b)
+	}
+	return files
+}
+
+func TestRepackage(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	writeTestArchive(t, "app-1.0.0.tgz", gzip.NoCompression)
+	before, _ := os.Stat("app-1.0.0.tgz")
+
+	if err := repackage("app-1.0.0.tgz", gzip.BestCompression); err != nil {
+		t.Fatalf("repackage() error = %v", err)
+	}
+	after, err := os.Stat("app-1.0.0.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("repackaged size %d is not smaller than %d", after.Size(), before.Size())
+	}
+	if after.Mode() != before.Mode() {
+		t.Errorf("repackaged mode = %v, want %v", after.Mode(), before.Mode())
+	}
+	if err := verifyArchive("app-1.0.0.tgz"); err != nil {
+		t.Errorf("repackaged archive is invalid: %v", err)
+	}
+	got := readArchive(t, "app-1.0.0.tgz")
+	if len(got) != len(testChartFiles) {
+		t.Errorf("repackaged archive has %d files, want %d", len(got), len(testChartFiles))
+	}
+	for name, content := range testChartFiles {
+		if got[name] != content {
+			t.Errorf("repackaged %s = %q, want it unchanged", name, got[name])
+		}
+	}
+	// no temp files are left behind
+	if files, _ := ioutil.ReadDir("."); len(files) != 1 {
+		t.Errorf("repackage() left %d files", len(files))
+	}
+}
+
+func TestRepackageInvalid(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+
+	if err := ioutil.WriteFile("plain.tgz", []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := repackage("plain.tgz", gzip.BestCompression); err == nil {
+		t.Error("repackage() of a plain file succeeded")
+	}
+	if b, _ := ioutil.ReadFile("plain.tgz"); string(b) != "not gzip" {
+		t.Errorf("repackage() changed the invalid file to %q", b)
+	}
+
+	if err := repackage("missing.tgz", gzip.BestCompression); err == nil {
+		t.Error("repackage() of a missing file succeeded")
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	writeTestArchive(t, "app.tgz", gzip.DefaultCompression)
+	b, _ := ioutil.ReadFile("app.tgz")
+
+	// gzip without a tar inside
+	var plain bytes.Buffer
+	zw := gzip.NewWriter(&plain)
+	zw.Write([]byte(strings.Repeat("not a tar archive", 40)))
+	zw.Close()
+
+	tests := []struct {
+		name    string
+		content []byte
+		wantErr bool
+	}{
+		{"valid", b, false},
+		{"truncated", b[:len(b)/2], true},
+		{"not gzip", []byte("not gzip"), true},
+		{"not tar", plain.Bytes(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile("test.tgz", tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyArchive("test.tgz"); (err != nil) != tt.wantErr {
+				t.Errorf("verifyArchive() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreatePackageRepackage(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	writeTestArchive(t, "helm-package.tgz", gzip.NoCompression)
+	_, restoreCommands := fakeCommands(t, map[string]string{"helm": "cp helm-package.tgz app-1.0.0.tgz"})
+	defer restoreCommands()
+
+	p := newTestPlugin()
+	p.RepackageGzip = gzip.BestCompression
+	if err := p.createPackage(); err != nil {
+		t.Fatalf("createPackage() error = %v", err)
+	}
+	packaged, _ := os.Stat("helm-package.tgz")
+	repackaged, _ := os.Stat("app-1.0.0.tgz")
+	if repackaged.Size() >= packaged.Size() {
+		t.Errorf("package size %d is not smaller than the helm package size %d", repackaged.Size(), packaged.Size())
+	}
+	if err := verifyArchive("app-1.0.0.tgz"); err != nil {
+		t.Errorf("package is invalid: %v", err)
+	}
+}
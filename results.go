@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// ActionResult describes the outcome of a single executed action. An action
+// with warnings succeeded, but reported problems.
+type ActionResult struct {
+	Action   string
+	Chart    string
+	Success  bool
+	Warning  bool
+	Duration time.Duration
+	Message  string
+}
+
+// actionWarning is returned by actions which completed with warnings, like
+// lint warnings. It does not fail the run.
+type actionWarning struct {
+	msg string
+}
+
+func (w *actionWarning) Error() string {
+	return w.msg
+}
+
+// isWarning reports whether err only reports warnings of a completed action
+func isWarning(err error) bool {
+	var w *actionWarning
+	return errors.As(err, &w)
+}
+
+func newActionResult(action, chart string, d time.Duration, err error) ActionResult {
+	r := ActionResult{
+		Action:   action,
+		Chart:    chart,
+		Success:  err == nil || isWarning(err),
+		Warning:  isWarning(err),
+		Duration: d,
+		Message:  "ok",
+	}
+	if err != nil {
+		r.Message = err.Error()
+	}
+	return r
+}
+
+// printResults writes a summary table of all executed actions to w.
+func printResults(w io.Writer, results []ActionResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tCHART\tSTATUS\tDURATION\tMESSAGE")
+	for _, r := range results {
+		status := "success"
+		switch {
+		case !r.Success:
+			status = "failed"
+		case r.Warning:
+			status = "warning"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Action, r.Chart, status, r.Duration.Round(time.Millisecond), r.Message)
+	}
+	tw.Flush()
+}
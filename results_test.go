@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewActionResult(t *testing.T) {
+	ok := newActionResult(deployPkg, "chart", 2*time.Second, nil)
+	if !ok.Success || ok.Message != "ok" || ok.Duration != 2*time.Second {
+		t.Errorf("newActionResult() = %+v, want a successful result of 2s", ok)
+	}
+
+	warned := newActionResult(lintPkg, "chart", time.Second, &actionWarning{msg: "1 warnings"})
+	if !warned.Success || !warned.Warning || warned.Message != "1 warnings" {
+		t.Errorf("newActionResult() = %+v, want a successful result with warnings", warned)
+	}
+
+	failed := newActionResult(testPkg, "chart", time.Second, errors.New("tests failed"))
+	if failed.Success || failed.Message != "tests failed" {
+		t.Errorf("newActionResult() = %+v, want a failed result with the error", failed)
+	}
+}
+
+func TestPrintResults(t *testing.T) {
+	var b bytes.Buffer
+	printResults(&b, []ActionResult{
+		newActionResult(lintPkg, "chart", 1500*time.Millisecond, nil),
+		newActionResult(lintPkg, "chart", time.Second, &actionWarning{msg: "warnings"}),
+		newActionResult(deployPkg, "chart", 3*time.Second, errors.New("timed out")),
+	})
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("printResults() printed %d lines, want a header and 3 results:\n%s", len(lines), b.String())
+	}
+	for i, want := range [][]string{
+		{"ACTION", "CHART", "STATUS", "DURATION", "MESSAGE"},
+		{"lint", "chart", "success", "1.5s", "ok"},
+		{"lint", "chart", "warning", "1s", "warnings"},
+		{"deploy", "chart", "failed", "3s", "timed out"},
+	} {
+		if got := strings.Fields(lines[i]); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("line %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestPrintResultsEmpty(t *testing.T) {
+	var b bytes.Buffer
+	printResults(&b, nil)
+	if b.Len() != 0 {
+		t.Errorf("printResults() printed %q without results", b.String())
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mozilla-services/yaml"
+)
+
+// mergeYAML deep merges the yaml documents in order, later documents
+// override earlier ones. Maps are merged, all other values are replaced,
+// like helm does for value files.
+func mergeYAML(docs [][]byte) ([]byte, error) {
+	merged := map[interface{}]interface{}{}
+	for i, d := range docs {
+		var values map[interface{}]interface{}
+		if err := yaml.Unmarshal(d, &values); err != nil {
+			return nil, fmt.Errorf("could not parse document %d: %w", i, err)
+		}
+		mergeMaps(merged, values)
+	}
+	return yaml.Marshal(merged)
+}
+
+// mergeMaps merges src into dst
+func mergeMaps(dst, src map[interface{}]interface{}) {
+	for k, v := range src {
+		srcMap, srcOK := v.(map[interface{}]interface{})
+		dstMap, dstOK := dst[k].(map[interface{}]interface{})
+		if srcOK && dstOK {
+			mergeMaps(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/pgp"
+	"go.mozilla.org/sops/v3/version"
+)
+
+// testGPGKey creates a gpg key without passphrase in a new GNUPGHOME and
+// returns its fingerprint, restore kills the agent and resets GNUPGHOME
+func testGPGKey(t *testing.T) (fingerprint string, restore func()) {
+	t.Helper()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	home, err := ioutil.TempDir("", "gnupg-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, set := os.LookupEnv("GNUPGHOME")
+	os.Setenv("GNUPGHOME", home)
+	restore = func() {
+		exec.Command("gpgconf", "--kill", "gpg-agent").Run()
+		if set {
+			os.Setenv("GNUPGHOME", old)
+		} else {
+			os.Unsetenv("GNUPGHOME")
+		}
+		os.RemoveAll(home)
+	}
+
+	if out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "sops@example.com", "default", "default", "never").CombinedOutput(); err != nil {
+		restore()
+		t.Fatalf("could not create gpg key: %v\n%s", err, out)
+	}
+	out, err := exec.Command("gpg", "--list-secret-keys", "--with-colons").Output()
+	if err != nil {
+		restore()
+		t.Fatalf("could not list gpg keys: %v", err)
+	}
+	for _, l := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(l, "fpr:") {
+			return strings.Split(l, ":")[9], restore
+		}
+	}
+	restore()
+	t.Fatalf("no fingerprint in %s", out)
+	return "", nil
+}
+
+// writeSecret encrypts the keys matching encryptedRegex of the plain file
+// in the format with the gpg key and writes it as name, like
+// sops --input-type $FORMAT --encrypted-regex $REGEX --encrypt
+func writeSecret(t *testing.T, fingerprint, name, format, plain, encryptedRegex string) {
+	t.Helper()
+	store := common.DefaultStoreForPathOrFormat(name, format)
+	branches, err := store.LoadPlainFile([]byte(plain))
+	if err != nil {
+		t.Fatalf("could not load %s: %v", name, err)
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:      []sops.KeyGroup{{pgp.NewMasterKeyFromFingerprint(fingerprint)}},
+			EncryptedRegex: encryptedRegex,
+			Version:        version.Version,
+		},
+	}
+	dataKey, errs := tree.GenerateDataKey()
+	if len(errs) > 0 {
+		t.Fatalf("could not create data key: %v", errs)
+	}
+	if err := common.EncryptTree(common.EncryptTreeOpts{Tree: &tree, Cipher: aes.NewCipher(), DataKey: dataKey}); err != nil {
+		t.Fatalf("could not encrypt %s: %v", name, err)
+	}
+	out, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		t.Fatalf("could not write %s: %v", name, err)
+	}
+	if err := ioutil.WriteFile(name, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deployedSecrets deploys with fake commands and returns the content of the
+// value files passed to helm upgrade
+func deployedSecrets(t *testing.T, p Plugin) []string {
+	t.Helper()
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm": `[ "$1" = upgrade ] || exit 0
+while [ $# -gt 0 ]; do
+	if [ "$1" = -f ]; then echo "file:" >> "$FAKE_DIR/calls"; sed 's/^/  /' "$2" >> "$FAKE_DIR/calls"; fi
+	shift
+done`,
+		"kubectl": `echo 'deployment "app" successfully rolled out'`,
+	})
+	defer restore()
+
+	if err := p.deployPackage(); err != nil {
+		t.Fatalf("deployPackage() error = %v", err)
+	}
+	var files []string
+	for _, c := range calls() {
+		switch {
+		case c == "file:":
+			files = append(files, "")
+		case strings.HasPrefix(c, "  ") && len(files) > 0:
+			files[len(files)-1] += strings.TrimPrefix(c, "  ") + "\n"
+		}
+	}
+	return files
+}
+
+func TestSecretFormat(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"secrets.yaml", "yaml"},
+		{"secrets.yml", "yaml"},
+		{"secrets.json", "json"},
+		{"secrets.JSON", "json"},
+		{"secrets.dec", "yaml"},
+		{"secrets", "yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := secretFormat(tt.path); got != tt.want {
+				t.Errorf("secretFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployPartiallyEncryptedSecrets(t *testing.T) {
+	fingerprint, restoreKey := testGPGKey(t)
+	defer restoreKey()
+	dir, restore := chdirTemp(t)
+	defer restore()
+
+	tests := []struct {
+		name   string
+		format string
+		plain  string
+		kept   string
+		want   string
+	}{
+		{
+			name:   "secrets.yaml",
+			format: "yaml",
+			plain:  "app:\n    replicas: 2\n    password: s3cret\n    hosts:\n    - a.example.com\n    - b.example.com\n",
+			want:   "app:\n    replicas: 2\n    password: s3cret\n    hosts:\n    - a.example.com\n    - b.example.com\n",
+		},
+		{
+			name:   "secrets.json",
+			format: "json",
+			plain:  `{"app": {"replicas": 2, "password": "s3cret"}}`,
+			kept:   `"replicas": 2`,
+			want:   "{\n\t\"app\": {\n\t\t\"replicas\": 2,\n\t\t\"password\": \"s3cret\"\n\t}\n}\n",
+		},
+		{
+			// without the format sops would decrypt the file as binary
+			name:   "secrets.dec",
+			format: "yaml",
+			plain:  "password: s3cret\nuser: app\n",
+			kept:   "user: app",
+			want:   "password: s3cret\nuser: app\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeSecret(t, fingerprint, filepath.Join(dir, tt.name), tt.format, tt.plain, "^password$")
+			encrypted, _ := ioutil.ReadFile(tt.name)
+			if strings.Contains(string(encrypted), "s3cret") {
+				t.Fatalf("password is not encrypted:\n%s", encrypted)
+			}
+			if !strings.Contains(string(encrypted), tt.kept) {
+				t.Fatalf("%s is encrypted:\n%s", tt.kept, encrypted)
+			}
+
+			p := newTestPlugin()
+			p.Secrets = []string{tt.name}
+			files := deployedSecrets(t, p)
+			if len(files) != 1 {
+				t.Fatalf("helm upgrade got %d value files, want the decrypted secrets", len(files))
+			}
+			if files[0] != tt.want {
+				t.Errorf("decrypted secrets =\n%s\nwant\n%s", files[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		docs    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "later overrides",
+			docs: []string{"a: 1\nb: 1\n", "b: 2\n"},
+			want: "a: 1\nb: 2\n",
+		},
+		{
+			name: "maps are merged",
+			docs: []string{"db:\n  user: app\n  password: one\n", "db:\n  password: two\n  port: 5432\n"},
+			want: "db:\n  password: two\n  port: 5432\n  user: app\n",
+		},
+		{
+			name: "lists are replaced",
+			docs: []string{"hosts:\n- a\n- b\n", "hosts:\n- c\n"},
+			want: "hosts:\n- c\n",
+		},
+		{
+			name: "map replaces scalar",
+			docs: []string{"db: none\n", "db:\n  user: app\n"},
+			want: "db:\n  user: app\n",
+		},
+		{
+			name: "scalar replaces map",
+			docs: []string{"db:\n  user: app\n", "db: none\n"},
+			want: "db: none\n",
+		},
+		{
+			name: "empty document",
+			docs: []string{"a: 1\n", ""},
+			want: "a: 1\n",
+		},
+		{
+			name:    "invalid document",
+			docs:    []string{"a: 1\n", "a: [1\n"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var docs [][]byte
+			for _, d := range tt.docs {
+				docs = append(docs, []byte(d))
+			}
+			got, err := mergeYAML(docs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeYAML() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("mergeYAML() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployMergeSecrets(t *testing.T) {
+	fingerprint, restoreKey := testGPGKey(t)
+	defer restoreKey()
+	dir, restore := chdirTemp(t)
+	defer restore()
+
+	writeSecret(t, fingerprint, filepath.Join(dir, "base.yaml"), "yaml", "db:\n    user: app\n    password: one\n", "^password$")
+	writeSecret(t, fingerprint, filepath.Join(dir, "prod.yaml"), "yaml", "db:\n    password: two\n", "^password$")
+
+	p := newTestPlugin()
+	p.Secrets = []string{"base.yaml", "prod.yaml"}
+	if files := deployedSecrets(t, p); len(files) != 2 {
+		t.Errorf("helm upgrade got %d value files, want one per secret file", len(files))
+	}
+
+	p.MergeSecrets = true
+	files := deployedSecrets(t, p)
+	if len(files) != 1 {
+		t.Fatalf("helm upgrade got %d value files, want the merged secrets", len(files))
+	}
+	if want := "db:\n  password: two\n  user: app\n"; files[0] != want {
+		t.Errorf("merged secrets =\n%s\nwant\n%s", files[0], want)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// runState are the actions completed by previous runs
+type runState struct {
+	// Completed are the state keys of the completed actions
+	Completed []string `json:"completed"`
+}
+
+// readState reads the state file. A missing file is an empty state.
+func readState(file string) (runState, error) {
+	var s runState
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	return s, json.Unmarshal(b, &s)
+}
+
+// writeState writes the state file
+func writeState(file string, s runState) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, b, 0644)
+}
+
+// stateKey identifies the action in the state file. An action only counts as
+// completed for the same release and chart version.
+func stateKey(action string, p Plugin) string {
+	return fmt.Sprintf("%s %s %s", action, p.Release, p.ChartVersion)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadWriteState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	s, err := readState(file)
+	if err != nil || len(s.Completed) != 0 {
+		t.Fatalf("readState() of a missing file = %+v, %v, want an empty state", s, err)
+	}
+	want := runState{Completed: []string{"lint app 1.0.0", "lint app 1.0.0"}}
+	if err := writeState(file, want); err != nil {
+		t.Fatalf("writeState() error = %v", err)
+	}
+	if s, err = readState(file); err != nil || strings.Join(s.Completed, ",") != strings.Join(want.Completed, ",") {
+		t.Errorf("readState() = %+v, %v, want %+v", s, err, want)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readState(file); err == nil {
+		t.Error("readState() of an invalid file succeeded")
+	}
+}
+
+func TestStateKey(t *testing.T) {
+	p := newTestPlugin()
+	if got, want := stateKey("deploy:namespace=staging", p), "deploy:namespace=staging app 1.0.0"; got != want {
+		t.Errorf("stateKey() = %q, want %q", got, want)
+	}
+	other := p
+	other.ChartVersion = "1.1.0"
+	if stateKey(deployPkg, p) == stateKey(deployPkg, other) {
+		t.Error("stateKey() is the same for another chart version")
+	}
+	other = p
+	other.Release = "other"
+	if stateKey(deployPkg, p) == stateKey(deployPkg, other) {
+		t.Error("stateKey() is the same for another release")
+	}
+}
+
+func TestExecStateFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		completed    []string
+		forceRerun   bool
+		chartVersion string
+		wantLints    int
+		wantPackages int
+	}{
+		{"no state", nil, false, "1.0.0", 2, 1},
+		{"resumed", []string{"lint app 1.0.0"}, false, "1.0.0", 1, 1},
+		{"resumed after repeated action", []string{"lint app 1.0.0", "create app 1.0.0", "lint app 1.0.0"}, false, "1.0.0", 0, 0},
+		{"other chart version", []string{"lint app 1.0.0", "create app 1.0.0"}, false, "1.1.0", 2, 1},
+		{"force rerun", []string{"lint app 1.0.0", "create app 1.0.0"}, true, "1.0.0", 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "state-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := filepath.Join(dir, "state.json")
+			if tt.completed != nil {
+				if err := writeState(file, runState{Completed: tt.completed}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			calls, restore := fakeCommands(t, map[string]string{"helm": "exit 0"})
+			defer restore()
+
+			p := newTestPlugin()
+			p.Actions = []string{lintPkg, createPkg, lintPkg}
+			p.ChartVersion = tt.chartVersion
+			p.StateFile = file
+			p.ForceRerun = tt.forceRerun
+			if err := p.Exec(); err != nil {
+				t.Fatalf("Exec() error = %v", err)
+			}
+
+			var lints, packages int
+			for _, c := range calls() {
+				switch {
+				case strings.HasPrefix(c, "helm lint"):
+					lints++
+				case strings.HasPrefix(c, "helm package"):
+					packages++
+				}
+			}
+			if lints != tt.wantLints || packages != tt.wantPackages {
+				t.Errorf("Exec() ran %d lints and %d packages, want %d and %d: %q", lints, packages, tt.wantLints, tt.wantPackages, calls())
+			}
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				t.Errorf("state file was kept after all actions completed: %v", err)
+			}
+		})
+	}
+}
+
+func TestExecStateFileFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+	fail := filepath.Join(dir, "fail")
+	if err := ioutil.WriteFile(fail, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls, restore := fakeCommands(t, map[string]string{
+		"helm": fmt.Sprintf(`[ "$1" = package ] && [ -e %s ] && exit 1; exit 0`, fail),
+	})
+	defer restore()
+
+	p := newTestPlugin()
+	p.Actions = []string{lintPkg, createPkg, lintPkg}
+	p.StateFile = file
+	if err := p.Exec(); err == nil {
+		t.Fatal("Exec() succeeded although the package failed")
+	}
+	s, err := readState(file)
+	if err != nil || strings.Join(s.Completed, ",") != "lint app 1.0.0" {
+		t.Fatalf("state after the failure = %+v, %v, want the first lint", s, err)
+	}
+
+	// the resumed run only skips the first lint
+	os.Remove(fail)
+	before := len(calls())
+	if err := p.Exec(); err != nil {
+		t.Fatalf("resumed Exec() error = %v", err)
+	}
+	resumed := calls()[before:]
+	if len(resumed) != 2 || !strings.HasPrefix(resumed[0], "helm package") || !strings.HasPrefix(resumed[1], "helm lint") {
+		t.Errorf("resumed Exec() ran %q, want the package and the second lint", resumed)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("state file was kept after the resumed run completed: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	missingKeyError = "error"
+	missingKeyWarn  = "warn"
+)
+
+// withTemplatedValues renders all value files with renderValueFile and
+// returns the plugin using the rendered files. The rendered files are
+// temporary files and must be removed by the caller, also on error.
+func (p Plugin) withTemplatedValues() (Plugin, []string, error) {
+	var rendered []string
+	for _, f := range append(p.valueFilesFromDir(), p.ValueFiles...) {
+		r, err := p.renderValueFile(f)
+		if r != "" {
+			rendered = append(rendered, r)
+		}
+		if err != nil {
+			return p, rendered, fmt.Errorf("could not template value file %s: %w", f, err)
+		}
+	}
+	p.ValueFilesDir = ""
+	p.ValueFiles = rendered
+	return p, rendered, nil
+}
+
+// renderValueFile runs the value file through text/template with the
+// environment variables as .Env and writes the result to a temporary file.
+func (p Plugin) renderValueFile(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	data := map[string]interface{}{"Env": environ()}
+
+	tmpl, err := template.New(filepath.Base(file)).Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		if p.TemplateMissingKey != missingKeyWarn {
+			return "", err
+		}
+		log.Printf("warning: %v, missing keys are rendered empty", err)
+		out.Reset()
+		if err := tmpl.Option("missingkey=zero").Execute(&out, data); err != nil {
+			return "", err
+		}
+	}
+
+	tmp, err := ioutil.TempFile(p.tempDir("."), "values-*"+filepath.Ext(file))
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := tmp.Write(out.Bytes()); err != nil {
+		return tmp.Name(), err
+	}
+	return tmp.Name(), nil
+}
+
+// environ returns the environment variables as map
+func environ() map[string]string {
+	env := map[string]string{}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		env[kv[0]] = kv[1]
+	}
+	return env
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderValueFile(t *testing.T) {
+	_, restore := chdirTemp(t)
+	defer restore()
+	defer restoreEnv("TEMPLATE_TEST_HOST", "TEMPLATE_TEST_MISSING")()
+	os.Setenv("TEMPLATE_TEST_HOST", "app.example.com")
+	os.Unsetenv("TEMPLATE_TEST_MISSING")
+
+	tests := []struct {
+		name       string
+		content    string
+		missingKey string
+		want       string
+		wantLog    string
+		wantErr    bool
+	}{
+		{
+			name:       "defined",
+			content:    "host: {{ .Env.TEMPLATE_TEST_HOST }}\n",
+			missingKey: missingKeyError,
+			want:       "host: app.example.com\n",
+		},
+		{
+			name:       "plain",
+			content:    "replicas: 2\n",
+			missingKey: missingKeyError,
+			want:       "replicas: 2\n",
+		},
+		{
+			name:       "missing",
+			content:    "host: {{ .Env.TEMPLATE_TEST_MISSING }}\n",
+			missingKey: missingKeyError,
+			wantErr:    true,
+		},
+		{
+			name:       "missing warning",
+			content:    "host: {{ .Env.TEMPLATE_TEST_HOST }}\nport: '{{ .Env.TEMPLATE_TEST_MISSING }}'\n",
+			missingKey: missingKeyWarn,
+			want:       "host: app.example.com\nport: ''\n",
+			wantLog:    "warning: ",
+		},
+		{
+			name:       "invalid template",
+			content:    "host: {{ .Env.TEMPLATE_TEST_HOST\n",
+			missingKey: missingKeyWarn,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile("values.yaml", []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			p := newTestPlugin()
+			p.TemplateMissingKey = tt.missingKey
+
+			var rendered string
+			var err error
+			lines := captureLog(func() { rendered, err = p.renderValueFile("values.yaml") })
+			if rendered != "" {
+				defer os.Remove(rendered)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderValueFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if filepath.Ext(rendered) != ".yaml" {
+				t.Errorf("rendered file %s has not the extension of the value file", rendered)
+			}
+			b, _ := ioutil.ReadFile(rendered)
+			if string(b) != tt.want {
+				t.Errorf("rendered values =\n%s\nwant\n%s", b, tt.want)
+			}
+			if got := strings.Join(lines, "\n"); tt.wantLog != "" && !strings.Contains(got, tt.wantLog) {
+				t.Errorf("logged %q, want %q", got, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestWithTemplatedValues(t *testing.T) {
+	dir, restore := chdirTemp(t)
+	defer restore()
+	defer restoreEnv("TEMPLATE_TEST_HOST")()
+	os.Setenv("TEMPLATE_TEST_HOST", "app.example.com")
+
+	os.Mkdir("values", 0755)
+	ioutil.WriteFile(filepath.Join("values", "a.yaml"), []byte("a: {{ .Env.TEMPLATE_TEST_HOST }}\n"), 0644)
+	ioutil.WriteFile("b.yaml", []byte("b: {{ .Env.TEMPLATE_TEST_HOST }}\n"), 0644)
+	ioutil.WriteFile("c.yaml", []byte("c: {{ .Env.TEMPLATE_TEST_MISSING }}\n"), 0644)
+
+	p := newTestPlugin()
+	p.ValueFilesDir = "values"
+	p.ValueFiles = []string{"b.yaml"}
+	templated, rendered, err := p.withTemplatedValues()
+	defer removeFiles(rendered)
+	if err != nil {
+		t.Fatalf("withTemplatedValues() error = %v", err)
+	}
+	if templated.ValueFilesDir != "" || len(templated.ValueFiles) != 2 {
+		t.Fatalf("withTemplatedValues() = %q, %q, want the two rendered files", templated.ValueFilesDir, templated.ValueFiles)
+	}
+	for i, want := range []string{"a: app.example.com\n", "b: app.example.com\n"} {
+		if b, _ := ioutil.ReadFile(templated.ValueFiles[i]); string(b) != want {
+			t.Errorf("rendered file %d = %q, want %q", i, b, want)
+		}
+		if filepath.Dir(templated.ValueFiles[i]) != "." {
+			t.Errorf("rendered file %s is not in %s", templated.ValueFiles[i], dir)
+		}
+	}
+
+	p.ValueFiles = []string{"b.yaml", "c.yaml"}
+	_, rendered, err = p.withTemplatedValues()
+	defer removeFiles(rendered)
+	if err == nil || !strings.Contains(err.Error(), "c.yaml") {
+		t.Errorf("withTemplatedValues() error = %v, want the failed value file", err)
+	}
+	// the rendered files are returned for cleanup also on error
+	if len(rendered) != 2 {
+		t.Errorf("withTemplatedValues() returned %d rendered files, want 2", len(rendered))
+	}
+}
+
+func TestValidateTemplateMissingKey(t *testing.T) {
+	for _, mode := range []string{missingKeyError, missingKeyWarn} {
+		p := newTestPlugin()
+		p.TemplateMissingKey = mode
+		if err := p.validate(); err != nil {
+			t.Errorf("validate() with %q error = %v", mode, err)
+		}
+	}
+	p := newTestPlugin()
+	p.TemplateMissingKey = "ignore"
+	if err := p.validate(); err == nil {
+		t.Error("validate() accepted an unknown missing key mode")
+	}
+}